@@ -0,0 +1,27 @@
+// Package broker provides the publish/subscribe messaging that flixy servers
+// use to fan session events out to each other, so that members of the same
+// session can be connected to different servers.
+package broker
+
+// Broker delivers every message published on a channel to every subscriber
+// of that channel, including subscribers in the publishing process.
+// Implementations must be safe for use by multiple goroutines.
+type Broker interface {
+	// Publish sends msg to every subscriber of channel.
+	Publish(channel string, msg []byte) error
+
+	// Subscribe calls f with every message published on channel until
+	// the returned subscription is cancelled. f must not block, as it
+	// may hold up the delivery of other messages.
+	Subscribe(channel string, f func(msg []byte)) (Subscription, error)
+
+	// Close releases the broker's resources. No more messages are
+	// delivered once it returns.
+	Close() error
+}
+
+// Subscription is a single subscriber's interest in a channel.
+type Subscription interface {
+	// Unsubscribe stops the delivery of messages to the subscriber.
+	Unsubscribe() error
+}
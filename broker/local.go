@@ -0,0 +1,76 @@
+package broker
+
+import "sync"
+
+// Local is a `Broker` which only delivers messages within the current
+// process. It is what a single flixy server uses when it has nobody to
+// share its sessions with.
+type Local struct {
+	mu       sync.RWMutex
+	channels map[string]map[*localSubscription]struct{}
+}
+
+// localSubscription is a `Subscription` to a `Local` broker.
+type localSubscription struct {
+	l       *Local
+	channel string
+	f       func([]byte)
+}
+
+// NewLocal returns a new `Local` broker with no subscribers.
+func NewLocal() *Local {
+	return &Local{
+		channels: make(map[string]map[*localSubscription]struct{}),
+	}
+}
+
+// Publish implements `Broker`. Subscribers are called synchronously, in the
+// publishing goroutine.
+func (l *Local) Publish(channel string, msg []byte) error {
+	l.mu.RLock()
+	subs := make([]*localSubscription, 0, len(l.channels[channel]))
+	for sub := range l.channels[channel] {
+		subs = append(subs, sub)
+	}
+	l.mu.RUnlock()
+
+	for _, sub := range subs {
+		sub.f(msg)
+	}
+	return nil
+}
+
+// Subscribe implements `Broker`.
+func (l *Local) Subscribe(channel string, f func([]byte)) (Subscription, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sub := &localSubscription{l, channel, f}
+	if l.channels[channel] == nil {
+		l.channels[channel] = make(map[*localSubscription]struct{})
+	}
+	l.channels[channel][sub] = struct{}{}
+
+	return sub, nil
+}
+
+// Close implements `Broker`.
+func (l *Local) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.channels = make(map[string]map[*localSubscription]struct{})
+	return nil
+}
+
+// Unsubscribe implements `Subscription`.
+func (sub *localSubscription) Unsubscribe() error {
+	sub.l.mu.Lock()
+	defer sub.l.mu.Unlock()
+
+	delete(sub.l.channels[sub.channel], sub)
+	if len(sub.l.channels[sub.channel]) == 0 {
+		delete(sub.l.channels, sub.channel)
+	}
+	return nil
+}
@@ -0,0 +1,464 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/flixy/flixy/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+var (
+	// errProtocol is returned when a Redis server sends something that
+	// isn't valid RESP.
+	errProtocol = errors.New("redis: protocol error")
+
+	// errSubscribeTimeout is returned when a Redis server doesn't confirm
+	// a subscription within `SubscribeTimeout`.
+	errSubscribeTimeout = errors.New("redis: timed out subscribing")
+)
+
+var (
+	// SubscribeTimeout is how long `Redis.Subscribe` waits for the server
+	// to confirm a subscription.
+	SubscribeTimeout = 5 * time.Second
+
+	// reconnectMin and reconnectMax are how long the subscription
+	// connection waits before its first attempt to reconnect, and at most
+	// between later ones.
+	reconnectMin = 100 * time.Millisecond
+	reconnectMax = 10 * time.Second
+)
+
+// redisError is an error reply sent by a Redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// Redis is a `Broker` which uses the PUBLISH and SUBSCRIBE commands of a
+// Redis server (or anything else speaking the same protocol), so that any
+// number of flixy servers pointed at the same Redis server share their
+// messages.
+//
+// It holds two connections: one for publishing, and one which is kept in
+// subscribe mode and read from in its own goroutine. Either is redialed if it
+// drops, and every channel is subscribed to again on the new one, although
+// whatever is published in the meantime is lost.
+type Redis struct {
+	addr string
+
+	// pmu serializes commands on pub.
+	pmu sync.Mutex
+	pub *redisConn
+
+	// smu guards sub, channels and closed.
+	smu      sync.Mutex
+	sub      *redisConn
+	channels map[string]*redisChannel
+	closed   bool
+
+	// done is closed when the broker is.
+	done chan struct{}
+}
+
+// redisChannel is a channel a `Redis` broker is subscribed to.
+type redisChannel struct {
+	subs map[*redisSubscription]struct{}
+
+	// ready is closed once the server has confirmed the subscription.
+	ready chan struct{}
+}
+
+// redisSubscription is a `Subscription` to a `Redis` broker.
+type redisSubscription struct {
+	r       *Redis
+	channel string
+	f       func([]byte)
+}
+
+// DialRedis connects to the Redis server at the given address.
+func DialRedis(addr string) (*Redis, error) {
+	pub, err := dialRedisConn(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := dialRedisConn(addr)
+	if err != nil {
+		pub.Close()
+		return nil, err
+	}
+
+	r := &Redis{
+		addr:     addr,
+		pub:      pub,
+		sub:      sub,
+		channels: make(map[string]*redisChannel),
+		done:     make(chan struct{}),
+	}
+	go r.listen()
+
+	return r, nil
+}
+
+// isClosed returns whether the broker has been closed.
+func (r *Redis) isClosed() bool {
+	r.smu.Lock()
+	defer r.smu.Unlock()
+
+	return r.closed
+}
+
+// Publish implements `Broker`. If the publishing connection has dropped, it
+// is redialed and the message published on the new one.
+func (r *Redis) Publish(channel string, msg []byte) error {
+	r.pmu.Lock()
+	defer r.pmu.Unlock()
+
+	if r.isClosed() {
+		return io.ErrClosedPipe
+	}
+
+	err := r.publish(channel, msg)
+	if _, ok := err.(redisError); err == nil || ok {
+		return err
+	}
+
+	c, derr := dialRedisConn(r.addr)
+	if derr != nil {
+		return err
+	}
+	r.pub.Close()
+	r.pub = c
+
+	return r.publish(channel, msg)
+}
+
+// publish sends a PUBLISH on the publishing connection and reads its reply.
+// The caller must hold pmu.
+func (r *Redis) publish(channel string, msg []byte) error {
+	if err := r.pub.send("PUBLISH", channel, string(msg)); err != nil {
+		return err
+	}
+
+	_, err := r.pub.read()
+	return err
+}
+
+// Subscribe implements `Broker`. It returns once the server has confirmed the
+// subscription, so that anything published from then on is delivered to f,
+// or with an error if it hasn't within `SubscribeTimeout`. f is called from
+// the goroutine reading the subscription connection.
+func (r *Redis) Subscribe(channel string, f func([]byte)) (Subscription, error) {
+	r.smu.Lock()
+	if r.closed {
+		r.smu.Unlock()
+		return nil, io.ErrClosedPipe
+	}
+
+	ch := r.channels[channel]
+	if ch == nil {
+		ch = &redisChannel{
+			subs:  make(map[*redisSubscription]struct{}),
+			ready: make(chan struct{}),
+		}
+		r.channels[channel] = ch
+
+		// If this fails, the connection has dropped, and the channel
+		// will be subscribed to once it has been redialed.
+		r.sub.send("SUBSCRIBE", channel)
+	}
+
+	sub := &redisSubscription{r, channel, f}
+	ch.subs[sub] = struct{}{}
+	r.smu.Unlock()
+
+	select {
+	case <-ch.ready:
+		return sub, nil
+
+	case <-r.done:
+		return nil, io.ErrClosedPipe
+
+	case <-time.After(SubscribeTimeout):
+		sub.Unsubscribe()
+		return nil, errSubscribeTimeout
+	}
+}
+
+// Close implements `Broker`.
+func (r *Redis) Close() error {
+	r.smu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.done)
+	}
+	serr := r.sub.Close()
+	r.smu.Unlock()
+
+	r.pmu.Lock()
+	defer r.pmu.Unlock()
+
+	if err := r.pub.Close(); err != nil {
+		return err
+	}
+	return serr
+}
+
+// Unsubscribe implements `Subscription`.
+func (sub *redisSubscription) Unsubscribe() error {
+	r := sub.r
+
+	r.smu.Lock()
+	defer r.smu.Unlock()
+
+	ch, ok := r.channels[sub.channel]
+	if !ok {
+		return nil
+	}
+
+	delete(ch.subs, sub)
+	if len(ch.subs) > 0 {
+		return nil
+	}
+
+	delete(r.channels, sub.channel)
+	if r.closed {
+		return nil
+	}
+	return r.sub.send("UNSUBSCRIBE", sub.channel)
+}
+
+// listen reads the subscription connection until the broker is closed,
+// redialing it whenever it drops.
+func (r *Redis) listen() {
+	r.smu.Lock()
+	c := r.sub
+	r.smu.Unlock()
+
+	for {
+		err := r.read(c)
+		if r.isClosed() {
+			return
+		}
+		log.WithField("broker", "redis").Error(err)
+
+		if c = r.reconnect(); c == nil {
+			return
+		}
+	}
+}
+
+// read reads the given subscription connection until it fails, confirming
+// subscriptions and handing every message to the subscribers of its channel.
+func (r *Redis) read(c *redisConn) error {
+	for {
+		reply, err := c.read()
+		if err != nil {
+			return err
+		}
+
+		// Replies to SUBSCRIBE and UNSUBSCRIBE arrive on the same
+		// connection as messages do.
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 {
+			continue
+		}
+		kind, _ := parts[0].([]byte)
+		channel, _ := parts[1].([]byte)
+
+		switch string(kind) {
+		case "subscribe":
+			r.confirm(string(channel))
+
+		case "message":
+			msg, _ := parts[2].([]byte)
+			r.deliver(string(channel), msg)
+		}
+	}
+}
+
+// confirm marks the subscription to the given channel as confirmed, if it is
+// still subscribed to.
+func (r *Redis) confirm(channel string) {
+	r.smu.Lock()
+	defer r.smu.Unlock()
+
+	ch, ok := r.channels[channel]
+	if !ok {
+		return
+	}
+	select {
+	case <-ch.ready:
+	default:
+		close(ch.ready)
+	}
+}
+
+// deliver hands the given message to every subscriber of the given channel.
+func (r *Redis) deliver(channel string, msg []byte) {
+	r.smu.Lock()
+	ch := r.channels[channel]
+	var subs []*redisSubscription
+	if ch != nil {
+		subs = make([]*redisSubscription, 0, len(ch.subs))
+		for sub := range ch.subs {
+			subs = append(subs, sub)
+		}
+	}
+	r.smu.Unlock()
+
+	for _, sub := range subs {
+		sub.f(msg)
+	}
+}
+
+// reconnect redials the subscription connection, backing off between
+// attempts, and subscribes to every channel again on the new connection. It
+// returns nil if the broker is closed first.
+func (r *Redis) reconnect() *redisConn {
+	delay := reconnectMin
+	for {
+		select {
+		case <-r.done:
+			return nil
+		case <-time.After(delay):
+		}
+
+		c, err := dialRedisConn(r.addr)
+		if err != nil {
+			log.WithField("broker", "redis").Error(err)
+			if delay *= 2; delay > reconnectMax {
+				delay = reconnectMax
+			}
+			continue
+		}
+
+		r.smu.Lock()
+		if r.closed {
+			r.smu.Unlock()
+			c.Close()
+			return nil
+		}
+
+		args := make([]string, 0, len(r.channels)+1)
+		args = append(args, "SUBSCRIBE")
+		for channel := range r.channels {
+			args = append(args, channel)
+		}
+		if len(args) > 1 {
+			if err := c.send(args...); err != nil {
+				r.smu.Unlock()
+				c.Close()
+				log.WithField("broker", "redis").Error(err)
+				continue
+			}
+		}
+
+		r.sub.Close()
+		r.sub = c
+		r.smu.Unlock()
+
+		log.WithField("broker", "redis").Info("reconnected")
+		return c
+	}
+}
+
+// redisConn is a connection to a Redis server speaking RESP.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dialRedisConn opens a `redisConn` to the given address.
+func dialRedisConn(addr string) (*redisConn, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisConn{c, bufio.NewReader(c)}, nil
+}
+
+// send writes a command made up of the given arguments.
+func (c *redisConn) send(args ...string) error {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n", len(arg))...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+
+	_, err := c.Write(buf)
+	return err
+}
+
+// read reads a single reply. Simple and bulk strings are returned as
+// []byte, integers as int64, arrays as []interface{} and nil replies as
+// nil. Error replies are returned as a `redisError`.
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+	body := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return []byte(body), nil
+
+	case '-':
+		return nil, redisError(body)
+
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, errProtocol
+		}
+		return n, nil
+
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		parts := make([]interface{}, n)
+		for i := range parts {
+			if parts[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return parts, nil
+	}
+
+	return nil, errProtocol
+}
@@ -0,0 +1,313 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a stand-in Redis server which only knows SUBSCRIBE,
+// UNSUBSCRIBE and PUBLISH.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu    sync.Mutex
+	conns map[*fakeRedisConn]bool
+	subs  map[string]map[*fakeRedisConn]bool
+
+	// delay is how long to wait before confirming a subscription.
+	delay time.Duration
+}
+
+// fakeRedisConn is a client connection to a `fakeRedis`.
+type fakeRedisConn struct {
+	*redisConn
+	wmu sync.Mutex
+}
+
+func (c *fakeRedisConn) reply(parts ...interface{}) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	buf := fmt.Sprintf("*%d\r\n", len(parts))
+	for _, p := range parts {
+		switch p := p.(type) {
+		case string:
+			buf += fmt.Sprintf("$%d\r\n%s\r\n", len(p), p)
+		case int:
+			buf += fmt.Sprintf(":%d\r\n", p)
+		}
+	}
+	c.Write([]byte(buf))
+}
+
+func (c *fakeRedisConn) replyInt(n int) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	fmt.Fprintf(c, ":%d\r\n", n)
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr := &fakeRedis{
+		ln:    ln,
+		conns: make(map[*fakeRedisConn]bool),
+		subs:  make(map[string]map[*fakeRedisConn]bool),
+	}
+	go fr.serve()
+	t.Cleanup(func() {
+		ln.Close()
+		fr.drop()
+	})
+	return fr
+}
+
+func (fr *fakeRedis) addr() string {
+	return fr.ln.Addr().String()
+}
+
+func (fr *fakeRedis) serve() {
+	for {
+		nc, err := fr.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &fakeRedisConn{redisConn: &redisConn{nc, bufio.NewReader(nc)}}
+		fr.mu.Lock()
+		fr.conns[c] = true
+		fr.mu.Unlock()
+		go fr.handle(c)
+	}
+}
+
+func (fr *fakeRedis) handle(c *fakeRedisConn) {
+	defer fr.forget(c)
+
+	for {
+		cmd, err := c.read()
+		if err != nil {
+			return
+		}
+		parts, _ := cmd.([]interface{})
+		if len(parts) == 0 {
+			return
+		}
+		args := make([]string, len(parts))
+		for i, p := range parts {
+			b, _ := p.([]byte)
+			args[i] = string(b)
+		}
+
+		switch args[0] {
+		case "SUBSCRIBE":
+			fr.mu.Lock()
+			delay := fr.delay
+			fr.mu.Unlock()
+			time.Sleep(delay)
+
+			for _, channel := range args[1:] {
+				fr.mu.Lock()
+				if fr.subs[channel] == nil {
+					fr.subs[channel] = make(map[*fakeRedisConn]bool)
+				}
+				fr.subs[channel][c] = true
+				fr.mu.Unlock()
+				c.reply("subscribe", channel, 1)
+			}
+
+		case "UNSUBSCRIBE":
+			for _, channel := range args[1:] {
+				fr.mu.Lock()
+				delete(fr.subs[channel], c)
+				fr.mu.Unlock()
+				c.reply("unsubscribe", channel, 0)
+			}
+
+		case "PUBLISH":
+			fr.mu.Lock()
+			subs := make([]*fakeRedisConn, 0, len(fr.subs[args[1]]))
+			for sub := range fr.subs[args[1]] {
+				subs = append(subs, sub)
+			}
+			fr.mu.Unlock()
+
+			for _, sub := range subs {
+				sub.reply("message", args[1], args[2])
+			}
+			c.replyInt(len(subs))
+		}
+	}
+}
+
+// forget drops everything the server knows about the given connection.
+func (fr *fakeRedis) forget(c *fakeRedisConn) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	delete(fr.conns, c)
+	for _, subs := range fr.subs {
+		delete(subs, c)
+	}
+	c.Close()
+}
+
+// drop closes every client connection, as a server restarting would.
+func (fr *fakeRedis) drop() {
+	fr.mu.Lock()
+	conns := make([]*fakeRedisConn, 0, len(fr.conns))
+	for c := range fr.conns {
+		conns = append(conns, c)
+	}
+	fr.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func dialTestRedis(t *testing.T, addr string) *Redis {
+	r, err := DialRedis(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// receive returns a subscriber function and a channel it sends every message
+// it is called with on.
+func receive() (func([]byte), chan string) {
+	msgs := make(chan string, 16)
+	return func(msg []byte) { msgs <- string(msg) }, msgs
+}
+
+func expect(t *testing.T, msgs chan string, want string) {
+	t.Helper()
+
+	select {
+	case got := <-msgs:
+		if got != want {
+			t.Errorf("got message %q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+func TestRedisPublishSubscribe(t *testing.T) {
+	fr := newFakeRedis(t)
+	a := dialTestRedis(t, fr.addr())
+	b := dialTestRedis(t, fr.addr())
+
+	f, msgs := receive()
+	sub, err := a.Subscribe("flixy", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("flixy", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, msgs, "hello")
+
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("flixy", []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-msgs:
+		t.Errorf("got %q after unsubscribing", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestRedisSubscribeWaits checks that a message published as soon as
+// `Subscribe` returns is delivered, however slowly the server confirms the
+// subscription.
+func TestRedisSubscribeWaits(t *testing.T) {
+	fr := newFakeRedis(t)
+	fr.delay = 100 * time.Millisecond
+	a := dialTestRedis(t, fr.addr())
+	b := dialTestRedis(t, fr.addr())
+
+	f, msgs := receive()
+	if _, err := a.Subscribe("flixy", f); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("flixy", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, msgs, "hello")
+}
+
+func TestRedisSubscribeTimeout(t *testing.T) {
+	timeout := SubscribeTimeout
+	SubscribeTimeout = 50 * time.Millisecond
+	defer func() { SubscribeTimeout = timeout }()
+
+	fr := newFakeRedis(t)
+	fr.delay = time.Second
+	a := dialTestRedis(t, fr.addr())
+
+	if _, err := a.Subscribe("flixy", func([]byte) {}); err != errSubscribeTimeout {
+		t.Errorf("got error %v, want %v", err, errSubscribeTimeout)
+	}
+}
+
+func TestRedisReconnect(t *testing.T) {
+	min := reconnectMin
+	reconnectMin = 10 * time.Millisecond
+	defer func() { reconnectMin = min }()
+
+	fr := newFakeRedis(t)
+	a := dialTestRedis(t, fr.addr())
+	b := dialTestRedis(t, fr.addr())
+
+	f, msgs := receive()
+	if _, err := a.Subscribe("flixy", f); err != nil {
+		t.Fatal(err)
+	}
+	g, others := receive()
+	if _, err := a.Subscribe("other", g); err != nil {
+		t.Fatal(err)
+	}
+
+	fr.drop()
+
+	// Whatever is published before the subscriptions are made again is
+	// lost, so keep publishing until something arrives.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if err := b.Publish("flixy", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-msgs:
+			if msg != "hello" {
+				t.Fatalf("got message %q, want %q", msg, "hello")
+			}
+		case <-time.After(20 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatal("never resubscribed after the connection dropped")
+			}
+			continue
+		}
+		break
+	}
+
+	if err := b.Publish("other", []byte("too")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, others, "too")
+}
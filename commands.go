@@ -2,284 +2,1064 @@ package main
 
 import (
 	"encoding/json"
+	"math"
+	"time"
 
 	log "github.com/flixy/flixy/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/flixy/flixy/Godeps/_workspace/src/github.com/googollee/go-socket.io"
 	"github.com/flixy/flixy/models"
 )
 
+// request is a single command sent by a client, along with everything needed
+// to log it and respond to it.
+type request struct {
+	so     socketio.Socket
+	sockid string
+	sockip string
+	verb   string
+
+	// id is the `request_id` the client sent with the command, if any.
+	id string
+
+	// creds are the credentials the client sent with the command, if it
+	// can be sent by somebody who isn't a member of the session.
+	creds models.Credentials
+}
+
+// log returns a log entry with the fields every log line about a request
+// has.
+func (r *request) log() *log.Entry {
+	return log.WithFields(log.Fields{
+		"verb":          r.verb,
+		"member_sockid": r.sockid,
+		"member_remote": r.sockip,
+		"request_id":    r.id,
+	})
+}
+
+// decode unmarshals the given JSON message into data, picking out its
+// request ID as it goes.
+func (r *request) decode(jsonmsg string, data interface{}) error {
+	// The request ID is picked out separately so that it can be reported
+	// even if the rest of the message doesn't fit data.
+	var rm models.RequestMessage
+	if err := json.Unmarshal([]byte(jsonmsg), &rm); err == nil {
+		r.id = rm.RequestID
+	}
+
+	return json.Unmarshal([]byte(jsonmsg), data)
+}
+
+// internalMessage is what clients are told went wrong for internal errors,
+// whose details are only logged, as they are none of the client's business.
+const internalMessage = "something went wrong on the server's end"
+
+// fail logs the given error, reports it to the client with a `flixy error`
+// and returns the negative acknowledgement for the request.
+func (r *request) fail(code models.ErrorCode, err error) models.Ack {
+	we := models.WireError{
+		Code:      code,
+		Verb:      r.verb,
+		RequestID: r.id,
+		Message:   err.Error(),
+	}
+
+	entry := r.log().WithField("error_code", code)
+	if code == models.ErrCodeInternal {
+		entry.Error(err)
+		we.Message = internalMessage
+	} else {
+		entry.Warn(err)
+	}
+
+	r.so.Emit("flixy error", we)
+	return models.Ack{OK: false, Verb: r.verb, RequestID: r.id, Error: &we}
+}
+
+// ok returns the positive acknowledgement for the request.
+func (r *request) ok() models.Ack {
+	return models.Ack{OK: true, Verb: r.verb, RequestID: r.id}
+}
+
+// member returns the ID of the member the client is, which is its socket ID
+// unless it has resumed being a member who joined with another socket.
+func (r *request) member() string {
+	if m, ok := store.Member(r.sockid); ok {
+		return m.ID
+	}
+	return r.sockid
+}
+
+// session looks up the session with the given ID for the request, checking
+// that the client may see it if it has a password.
+func (r *request) session(sid string) (*models.Session, error) {
+	s, ok := store.Get(sid)
+	if !ok {
+		return nil, models.ErrNoSuchSession
+	}
+
+	c := r.creds
+	c.IP = r.sockip
+	if err := s.Authorize(r.member(), c); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// sendToken sends the client a session token for the given session, if it
+// has a password, so that it can get back in without it.
+func (r *request) sendToken(s *models.Session) {
+	if token := s.Token(); token != "" {
+		r.so.Emit("flixy session token", models.WireSessionToken{
+			SessionID: s.SessionID,
+			Token:     token,
+		})
+	}
+}
+
+// control looks up the session with the given ID for a request to play,
+// pause or seek it, checking that the requesting member is allowed to.
+func (r *request) control(sid string) (*models.Session, error) {
+	s, err := r.session(sid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.CanControl(r.member()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 // SyncHandler returns the handler for `flixy get sync`.
-func SyncHandler(so socketio.Socket) func(string) {
+func SyncHandler(so socketio.Socket) func(string) models.Ack {
 	sockid := so.Id()
 	sockip := getRemoteIP(so)
 
-	return func(jsonmsg string) {
-		var data models.GetSyncMessage
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy get sync"}
 
-		if err := json.Unmarshal([]byte(jsonmsg), &data); err != nil {
-			log.WithFields(log.Fields{
-				"verb":          "flixy get sync",
-				"member_sockid": sockid,
-				"member_remote": sockip,
-			}).Error(err)
-			return
+		var data models.GetSyncMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
 		}
+		req.creds = data.Credentials()
 
-		sid := data.SessionID
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
 
-		s, ok := sessions[sid]
-		if !ok {
-			log.WithFields(log.Fields{
-				"verb":          "flixy get sync",
-				"member_sockid": sockid,
-				"member_remote": sockip,
-				"invalid_sid":   sid,
-			}).Warn("invalid session id")
-			so.Emit("flixy invalid session id", sid)
-			return
-		}
-
-		log.WithFields(log.Fields{
-			"verb":          "flixy get sync",
-			"member_sockid": sockid,
-			"member_remote": sockip,
-		}).Debug("getting sync state")
+		req.log().Debug("getting sync state")
 		so.Emit("flixy sync", s.GetWireSession())
+		return req.ok()
 	}
 }
 
 // NewHandler returns the handler for `flixy new`.
-func NewHandler(so socketio.Socket) func(string) {
+func NewHandler(so socketio.Socket) func(string) models.Ack {
 	sockid := so.Id()
 	sockip := getRemoteIP(so)
 
-	return func(jsonmsg string) {
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy new"}
+
 		var data models.NewMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().Debug("client beginning new session creation")
+
+		nick := data.Nick
+		if nick == "" {
+			nick = "(no nick)"
+		}
+
+		media, _ := data.Video()
+		s, err := createSession(media, data.Time, so, nick, data.Options())
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+		if data.Password != "" {
+			req.sendToken(s)
+		}
+
+		so.Emit("flixy new session", s.GetWireSession())
+		req.log().WithField("session_id", s.SessionID).Info("new session created")
+		return req.ok()
+	}
+}
+
+// PauseHandler returns the handler for `flixy pause`.
+func PauseHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy pause"}
+
+		var data models.PauseMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.control(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		if err := s.Pause(req.member(), data.Version); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+		req.log().WithField("session_id", data.SessionID).Debug("pausing")
+		return req.ok()
+	}
+}
+
+// PlayHandler returns the handler for `flixy play`.
+func PlayHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy play"}
+
+		var data models.PlayMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
 
-		if err := json.Unmarshal([]byte(jsonmsg), &data); err != nil {
-			log.WithFields(log.Fields{
-				"verb":          "flixy new",
-				"member_sockid": sockid,
-				"member_remote": sockip,
-			}).Error(err)
+		s, err := req.control(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
 		}
 
-		log.WithFields(log.Fields{
-			"verb":          "flixy new",
-			"member_sockid": sockid,
-			"member_remote": sockip,
-		}).Debugf("client beginning new session creation", sockid)
+		if err := s.Play(req.member(), data.Version); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+		req.log().WithField("session_id", data.SessionID).Debug("playing")
+		return req.ok()
+	}
+}
 
-		sid := makeNewSessionID()
+// JoinHandler returns the handler for `flixy join`.
+func JoinHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
 
-		vid := data.VideoID
-		if vid == 0 {
-			log.WithFields(log.Fields{
-				"verb":          "flixy new",
-				"member_sockid": sockid,
-				"member_remote": sockip,
-			}).Warn("invalid video id?")
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy join"}
 
-			so.Emit("flixy invalid new data", jsonmsg)
-			return
+		var data models.JoinMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
 		}
 
-		time := data.Time
 		nick := data.Nick
 		if nick == "" {
 			nick = "(no nick)"
 		}
 
-		s := models.NewSession(sid, vid, time)
-		m := s.AddMember(so, nick)
-		members[sockid] = m
-		sessions[sid] = s
+		sid := data.SessionID
+		creds := models.Credentials{Password: data.Password, Token: data.Token, IP: sockip}
+		if data.Invite != "" {
+			inv, _ := models.ParseInvite(data.Invite)
+			sid = inv.SessionID
+			creds.Invite = inv.ID
+		}
+
+		m, err := store.Join(sid, so, nick, creds)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+		req.sendToken(m.Session)
 
-		so.Emit("flixy new session", s.GetWireSession())
-		// TODO make this the new style logging :-)
-		log.WithFields(log.Fields{
-			"verb":          "flixy new",
-			"member_sockid": sockid,
-			"member_remote": sockip,
-		}).Info("new session created")
+		req.log().WithFields(log.Fields{
+			"session_id": sid,
+			"invite_id":  creds.Invite,
+		}).Debug("joining a session")
+		return req.ok()
 	}
 }
 
-// PauseHandler returns the handler for `flixy pause`.
-func PauseHandler(so socketio.Socket) func(string) {
+// SeekHandler returns the handler for `flixy seek`.
+func SeekHandler(so socketio.Socket) func(string) models.Ack {
 	sockid := so.Id()
 	sockip := getRemoteIP(so)
 
-	return func(jsonmsg string) {
-		var data models.PauseMessage
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy seek"}
+
+		var data models.SeekMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
 
-		if err := json.Unmarshal([]byte(jsonmsg), &data); err != nil {
-			log.WithFields(log.Fields{
-				"verb":          "flixy pause",
-				"member_sockid": sockid,
-				"member_remote": sockip,
-			}).Error(err)
-			return
+		s, err := req.control(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
 		}
 
-		sid := data.SessionID
+		req.log().WithField("session_id", data.SessionID).Debug("setting time")
+		if err := s.SetTime(req.member(), data.Time, data.Version); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+		return req.ok()
+	}
+}
+
+// RateHandler returns the handler for `flixy rate`.
+func RateHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
 
-		log.Infof("%s pausing session %s", sockid, sid)
-		s, ok := sessions[sid]
-		if !ok {
-			log.WithFields(log.Fields{
-				"verb":          "flixy pause",
-				"member_sockid": sockid,
-				"member_remote": sockip,
-				"invalid_sid":   sid,
-			}).Warn("invalid session id")
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy rate"}
 
-			so.Emit("flixy invalid session id", sid)
-			return
+		var data models.RateMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.control(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
 		}
 
-		s.Pause()
-		log.WithFields(log.Fields{
-			"verb":          "flixy pause",
-			"member_sockid": sockid,
-			"member_remote": sockip,
-		}).Debug("pausing")
+		rate, err := s.SetRate(req.member(), data.Rate, data.Version)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"rate":       rate,
+		}).Debug("setting rate")
+		return req.ok()
 	}
 }
 
-// PlayHandler returns the handler for `flixy play`.
-func PlayHandler(so socketio.Socket) func(string) {
+// SetHostHandler returns the handler for `flixy set host`.
+func SetHostHandler(so socketio.Socket) func(string) models.Ack {
 	sockid := so.Id()
 	sockip := getRemoteIP(so)
 
-	return func(jsonmsg string) {
-		var data models.PlayMessage
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy set host"}
 
-		if err := json.Unmarshal([]byte(jsonmsg), &data); err != nil {
-			log.WithFields(log.Fields{
-				"verb":          "flixy play",
-				"member_sockid": sockid,
-				"member_remote": sockip,
-			}).Error(err)
-			return
+		var data models.SetHostMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
 		}
 
-		sid := data.SessionID
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		if err := s.SetHost(req.member(), data.MemberID); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
 
-		log.WithFields(log.Fields{
-			"verb":          "flixy play",
-			"member_sockid": sockid,
-			"member_remote": sockip,
-			"session_id":    sid,
-		}).Debug("user beginning session play")
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"new_host":   data.MemberID,
+		}).Info("handing over host")
+		return req.ok()
+	}
+}
+
+// SetPolicyHandler returns the handler for `flixy set policy`.
+func SetPolicyHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy set policy"}
 
-		s, ok := sessions[sid]
-		if !ok {
-			log.WithFields(log.Fields{
-				"verb":          "flixy play",
-				"member_sockid": sockid,
-				"member_remote": sockip,
-				"invalid_sid":   sid,
-			}).Warn("invalid session id")
+		var data models.SetPolicyMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
 
-			so.Emit("flixy invalid session id", sid)
-			return
+		if err := s.SetPolicy(req.member(), data.Policy); err != nil {
+			return req.fail(models.CodeOf(err), err)
 		}
 
-		s.Play()
-		log.WithFields(log.Fields{
-			"verb":          "flixy play",
-			"member_sockid": sockid,
-			"member_remote": sockip,
-		}).Debug("playing")
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"policy":     data.Policy,
+		}).Debug("setting control policy")
+		return req.ok()
 	}
 }
 
-// JoinHandler returns the handler for `flixy join`.
-func JoinHandler(so socketio.Socket) func(string) {
+// GrantHandler returns the handler for `flixy grant`.
+func GrantHandler(so socketio.Socket) func(string) models.Ack {
 	sockid := so.Id()
 	sockip := getRemoteIP(so)
 
-	return func(jsonmsg string) {
-		var data models.JoinMessage
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy grant"}
 
-		if err := json.Unmarshal([]byte(jsonmsg), &data); err != nil {
-			log.WithFields(log.Fields{
-				"verb":          "flixy join",
-				"member_sockid": sockid,
-				"member_remote": sockip,
-			}).Error(err)
-			return
+		var data models.GrantMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
 		}
 
-		sid := data.SessionID
-		nick := data.Nick
-		if nick == "" {
-			nick = "(no nick)"
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		if err := s.Grant(req.member(), data.MemberID, data.Control); err != nil {
+			return req.fail(models.CodeOf(err), err)
 		}
 
-		s, ok := sessions[sid]
-		if !ok {
-			log.WithFields(log.Fields{
-				"verb":          "flixy join",
-				"member_sockid": sockid,
-				"member_remote": sockip,
-				"invalid_sid":   sid,
-			}).Warn("invalid session id")
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"member_id":  data.MemberID,
+			"control":    data.Control,
+		}).Debug("granting control")
+		return req.ok()
+	}
+}
+
+// ChatHandler returns the handler for `flixy chat`.
+func ChatHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
 
-			so.Emit("flixy invalid session id", sid)
-			return
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy chat"}
+
+		var data models.ChatMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
 		}
 
-		s.AddMember(so, nick)
+		if err := s.Chat(req.member(), data.Text); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
 
-		log.WithFields(log.Fields{
-			"verb":          "flixy play",
-			"member_sockid": sockid,
-			"member_remote": sockip,
-			"session_id":    sid,
-		}).Debug("joining a session")
+		req.log().WithField("session_id", data.SessionID).Debug("chatting")
+		return req.ok()
 	}
 }
 
-// SeekHandler returns the handler for `flixy seek`.
-func SeekHandler(so socketio.Socket) func(string) {
+// AnnotateHandler returns the handler for `flixy annotate`.
+func AnnotateHandler(so socketio.Socket) func(string) models.Ack {
 	sockid := so.Id()
 	sockip := getRemoteIP(so)
 
-	return func(jsonmsg string) {
-		var data models.SeekMessage
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy annotate"}
+
+		var data models.AnnotateMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
 
-		if err := json.Unmarshal([]byte(jsonmsg), &data); err != nil {
-			log.WithFields(log.Fields{
-				"verb":          "flixy seek",
-				"member_sockid": sockid,
-				"member_remote": sockip,
-			}).Error(err)
-			return
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
 		}
 
-		sid := data.SessionID
-		ts := data.Time
-
-		s, ok := sessions[sid]
-		if !ok {
-			log.WithFields(log.Fields{
-				"verb":          "flixy seek",
-				"member_sockid": sockid,
-				"member_remote": sockip,
-				"invalid_sid":   sid,
-			}).Warn("invalid session id")
-			so.Emit("flixy invalid session id", sid)
-			return
-		}
-
-		log.WithFields(log.Fields{
-			"verb":          "flixy seek",
-			"member_sockid": sockid,
-			"member_remote": sockip,
-			"session":       sid,
-		}).Debug("setting time")
-		s.SetTime(ts)
+		wa, err := s.Annotate(req.member(), data.Kind, data.Text)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"kind":       wa.Kind,
+			"time":       wa.Time,
+		}).Debug("annotating")
+		return req.ok()
+	}
+}
+
+// GetAnnotationsHandler returns the handler for `flixy get annotations`.
+func GetAnnotationsHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy get annotations"}
+
+		var data models.GetAnnotationsMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		to := math.MaxInt32
+		if data.To != nil {
+			to = *data.To
+		}
+
+		was, err := s.Annotations(data.From, to)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithField("session_id", data.SessionID).Debug("getting annotations")
+		so.Emit("flixy annotations", was)
+		return req.ok()
+	}
+}
+
+// MemberStateHandler returns the handler for `flixy member state`.
+func MemberStateHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy member state"}
+
+		var data models.MemberStateMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		if err := s.SetMemberState(req.member(), data.State, data.Position); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"state":      data.State,
+			"position":   data.Position,
+		}).Debug("member reporting state")
+		return req.ok()
+	}
+}
+
+// SetAutoPauseHandler returns the handler for `flixy set auto pause`.
+func SetAutoPauseHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy set auto pause"}
+
+		var data models.SetAutoPauseMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		if err := s.SetAutoPause(req.member(), data.AutoPause); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"auto_pause": data.AutoPause,
+		}).Debug("setting auto pause")
+		return req.ok()
+	}
+}
+
+// PongHandler returns the handler for `flixy pong`.
+func PongHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy pong"}
+
+		var data models.PongMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		wl, err := s.Pong(req.member(), data.ServerTime, data.ClientTime)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"rtt":        wl.RTT,
+			"offset":     wl.Offset,
+		}).Debug("measured latency")
+		return req.ok()
+	}
+}
+
+// EnqueueHandler returns the handler for `flixy enqueue`.
+func EnqueueHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy enqueue"}
+
+		var data models.EnqueueMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.control(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		media, _ := data.Video()
+		item, err := s.Enqueue(req.member(), media, data.Duration)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"media":      item.Media.String(),
+			"item_id":    item.ID,
+		}).Debug("enqueueing")
+		return req.ok()
+	}
+}
+
+// ReorderHandler returns the handler for `flixy reorder`.
+func ReorderHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy reorder"}
+
+		var data models.ReorderMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.control(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		if err := s.Reorder(req.member(), data.ItemID, data.Index, data.Version); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"item_id":    data.ItemID,
+			"index":      data.Index,
+		}).Debug("reordering queue")
+		return req.ok()
+	}
+}
+
+// DequeueHandler returns the handler for `flixy dequeue`.
+func DequeueHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy dequeue"}
+
+		var data models.DequeueMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.control(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		if err := s.Dequeue(req.member(), data.ItemID, data.Version); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"item_id":    data.ItemID,
+		}).Debug("dequeueing")
+		return req.ok()
+	}
+}
+
+// AdvanceHandler returns the handler for `flixy advance`.
+func AdvanceHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy advance"}
+
+		var data models.AdvanceMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.control(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		if err := s.Advance(req.member(), data.Version); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithField("session_id", data.SessionID).Debug("advancing to next video")
+		return req.ok()
+	}
+}
+
+// ChangeVideoHandler returns the handler for `flixy change video`.
+func ChangeVideoHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy change video"}
+
+		var data models.ChangeVideoMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.control(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		media, _ := data.Video()
+		if err := s.ChangeVideo(req.member(), media, data.Time, data.Duration, data.Version); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"media":      media.String(),
+			"time":       data.Time,
+		}).Info("changing video")
+		return req.ok()
+	}
+}
+
+// CreateInviteHandler returns the handler for `flixy create invite`.
+func CreateInviteHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy create invite"}
+
+		var data models.CreateInviteMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		wi, err := s.CreateInvite(req.member(), time.Duration(data.TTL)*time.Second, data.MaxUses)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"invite_id":  wi.ID,
+		}).Debug("creating an invite")
+		so.Emit("flixy invite", wi)
+		return req.ok()
+	}
+}
+
+// RevokeInviteHandler returns the handler for `flixy revoke invite`.
+func RevokeInviteHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy revoke invite"}
+
+		var data models.RevokeInviteMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		if err := s.RevokeInvite(req.member(), data.InviteID); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"invite_id":  data.InviteID,
+		}).Debug("revoking an invite")
+		return req.ok()
+	}
+}
+
+// GetInvitesHandler returns the handler for `flixy get invites`.
+func GetInvitesHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy get invites"}
+
+		var data models.GetInvitesMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		wis, err := s.Invites(req.member())
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithField("session_id", data.SessionID).Debug("getting invites")
+		so.Emit("flixy invites", wis)
+		return req.ok()
+	}
+}
+
+// ResumeHandler returns the handler for `flixy resume`.
+func ResumeHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy resume"}
+
+		var data models.ResumeMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		m, err := store.Resume(data.SessionID, data.MemberID, data.Token, so)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+		req.sendToken(m.Session)
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"member_id":  data.MemberID,
+		}).Debug("resuming a session")
+		return req.ok()
+	}
+}
+
+// KickHandler returns the handler for `flixy kick`.
+func KickHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy kick"}
+
+		var data models.KickMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		if _, err := s.Kick(req.member(), data.MemberID, false); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"member_id":  data.MemberID,
+		}).Info("kicking a member")
+		return req.ok()
+	}
+}
+
+// BanHandler returns the handler for `flixy ban`.
+func BanHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy ban"}
+
+		var data models.BanMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		if _, err := s.Kick(req.member(), data.MemberID, true); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"member_id":  data.MemberID,
+		}).Info("banning a member")
+		return req.ok()
+	}
+}
+
+// NickHandler returns the handler for `flixy nick`.
+func NickHandler(so socketio.Socket) func(string) models.Ack {
+	sockid := so.Id()
+	sockip := getRemoteIP(so)
+
+	return func(jsonmsg string) models.Ack {
+		req := &request{so: so, sockid: sockid, sockip: sockip, verb: "flixy nick"}
+
+		var data models.NickMessage
+		if err := req.decode(jsonmsg, &data); err != nil {
+			return req.fail(models.ErrCodeBadJSON, err)
+		}
+		if err := data.Validate(); err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		s, err := req.session(data.SessionID)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		wn, err := s.SetNick(req.member(), data.Nick)
+		if err != nil {
+			return req.fail(models.CodeOf(err), err)
+		}
+
+		req.log().WithFields(log.Fields{
+			"session_id": data.SessionID,
+			"old":        wn.Old,
+			"nick":       wn.Nick,
+		}).Info("changing nick")
+		return req.ok()
 	}
 }
@@ -4,15 +4,21 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"html/template"
+	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"math/rand"
 	"net/http"
 
 	log "github.com/flixy/flixy/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	flag "github.com/flixy/flixy/Godeps/_workspace/src/github.com/ogier/pflag"
 
+	"github.com/flixy/flixy/broker"
 	"github.com/flixy/flixy/models"
 
 	"github.com/flixy/flixy/Godeps/_workspace/src/github.com/Xe/middleware"
@@ -24,9 +30,22 @@ import (
 
 // opts is the internal options string.
 type options struct {
-	Port     int
-	Host     string
-	LogLevel string
+	Port         int
+	Host         string
+	LogLevel     string
+	Store        string
+	Redis        string
+	IDFormat     string
+	Policy       string
+	AutoPause    bool
+	SyncInterval time.Duration
+	MinRate      float64
+	MaxRate      float64
+	TokenSecret  string
+	ResumeGrace  time.Duration
+	EmptyTTL     time.Duration
+	IdleTimeout  time.Duration
+	Proxies      string
 }
 
 var logLevels = map[string]log.Level{
@@ -41,29 +60,125 @@ var logLevels = map[string]log.Level{
 var (
 	opts     = options{}
 	loglevel log.Level
+
+	// proxies are the networks of the proxies in front of the server,
+	// which are trusted to say who they are forwarding for. It is set up
+	// in `init`, depending on `opts.Proxies`.
+	proxies []*net.IPNet
 )
 
-// sessions is a map of the session identifier to each Flixy session, generated
-// by `makeNewSessionID`
-var sessions = make(map[string]*models.Session)
+// store holds every Flixy session, keyed by the session identifier generated
+// by `makeNewSessionID`, along with which session each socket is a member of,
+// for ease of removing users from sessions after they disconnect and other
+// such happenstances. It is set up in `init`, depending on `opts.Store`.
+var store models.SessionStore
+
+// idFormat is the format new session IDs are generated in, chosen by
+// `opts.IDFormat`.
+var idFormat models.IDFormat
+
+// makeNewSessionID produces a random session identifier in `idFormat`, which
+// by default is of the form "%04d-%04d-%04d-%04d" but this is subject to
+// change and is an implementation detail.
+func makeNewSessionID() (string, error) {
+	return idFormat.Generate()
+}
+
+// maxSessionIDAttempts is how many session IDs `createSession` will try
+// before giving up. With any of the formats in `models.IDFormats`, even a
+// second attempt should be vanishingly rare.
+const maxSessionIDAttempts = 8
+
+// createSession creates a new session with the given options under a freshly
+// made session ID which is not already in use, with the given socket as its
+// first member.
+func createSession(media models.Media, ts int, so socketio.Socket, nick string, opts models.SessionOptions) (*models.Session, error) {
+	for i := 0; i < maxSessionIDAttempts; i++ {
+		sid, err := makeNewSessionID()
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := store.Create(sid, media, ts, so, nick, opts)
+		if err != models.ErrSessionExists {
+			return s, err
+		}
+
+		log.WithField("session_id", sid).Warn("session id collision, trying another")
+	}
+
+	return nil, models.ErrSessionExists
+}
+
+// getRemoteIP returns the IP address the given socket is connected from. If
+// it is connected through trusted proxies, that is the last address in
+// X-Forwarded-For which isn't one of them, since anything before it may have
+// been made up by the client.
+func getRemoteIP(so socketio.Socket) string {
+	r := so.Request()
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
 
-// members is a map of socket identifier to member, for ease of removing users
-// from sessions after they disconnect and other such happenstances
-var members = make(map[string]*models.Member)
+	var hops []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
 
-// makeNewSessionID produces a session identifier, which is currently of the
-// form "%4d-%4d-%4d-%4d" but this is subject to change and is an
-// implementation detail.
-func makeNewSessionID() string {
-	return fmt.Sprintf("%04d-%04d-%04d-%04d", rand.Intn(9999), rand.Intn(9999), rand.Intn(9999), rand.Intn(9999))
+// trustedProxy returns whether the given IP address is one of the proxies the
+// server is configured to trust.
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range proxies {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
-func getRemoteIP(so socketio.Socket) (sockip string) {
-	sockip = so.Request().RemoteAddr
-	if len(so.Request().Header.Get("X-Forwarded-For")) > 0 {
-		sockip = so.Request().Header.Get("X-Forwarded-For")
+// parseProxies parses a comma-separated list of IP addresses and CIDR
+// networks.
+func parseProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
 	}
-	return
+	return nets, nil
 }
 
 // init is a special function called before main(). used to set up such things
@@ -83,9 +198,62 @@ func init() {
 		defaultLogLevel = "info"
 	}
 
+	defaultIDFormat := os.Getenv("FLIXY_ID_FORMAT")
+	if defaultIDFormat == "" {
+		defaultIDFormat = "numeric"
+	}
+
+	defaultPolicy := os.Getenv("FLIXY_CONTROL_POLICY")
+	if defaultPolicy == "" {
+		defaultPolicy = string(models.PolicyEveryone)
+	}
+
+	defaultAutoPause, _ := strconv.ParseBool(os.Getenv("FLIXY_AUTO_PAUSE"))
+
+	defaultSyncInterval, err := time.ParseDuration(os.Getenv("FLIXY_SYNC_INTERVAL"))
+	if err != nil {
+		defaultSyncInterval = models.SyncInterval
+	}
+
+	defaultResumeGrace, err := time.ParseDuration(os.Getenv("FLIXY_RESUME_GRACE"))
+	if err != nil {
+		defaultResumeGrace = models.ResumeGrace
+	}
+
+	defaultEmptyTTL, err := time.ParseDuration(os.Getenv("FLIXY_EMPTY_TTL"))
+	if err != nil {
+		defaultEmptyTTL = models.EmptyTTL
+	}
+	defaultIdleTimeout, err := time.ParseDuration(os.Getenv("FLIXY_IDLE_TIMEOUT"))
+	if err != nil {
+		defaultIdleTimeout = models.IdleTimeout
+	}
+
+	defaultMinRate, err := strconv.ParseFloat(os.Getenv("FLIXY_MIN_RATE"), 64)
+	if err != nil {
+		defaultMinRate = models.MinRate
+	}
+	defaultMaxRate, err := strconv.ParseFloat(os.Getenv("FLIXY_MAX_RATE"), 64)
+	if err != nil {
+		defaultMaxRate = models.MaxRate
+	}
+
 	flag.IntVarP(&opts.Port, "port", "p", defaultPort, "the port to listen on")
 	flag.StringVarP(&opts.Host, "host", "H", defaultHost, "the host to listen on")
 	flag.StringVarP(&opts.LogLevel, "log-level", "l", defaultLogLevel, "the log level to use (possible: panic,fatal,error,warn,info,debug)")
+	flag.StringVarP(&opts.Store, "store", "s", os.Getenv("FLIXY_STORE"), "the file to persist sessions to (sessions are only kept in memory if empty)")
+	flag.StringVarP(&opts.IDFormat, "id-format", "i", defaultIDFormat, "the format to generate session IDs in (possible: numeric,base32,words)")
+	flag.StringVarP(&opts.Policy, "control-policy", "c", defaultPolicy, "who may control sessions which don't say otherwise (possible: everyone,host,grants)")
+	flag.BoolVarP(&opts.AutoPause, "auto-pause", "a", defaultAutoPause, "whether sessions which don't say otherwise pause while anybody is buffering")
+	flag.DurationVarP(&opts.SyncInterval, "sync-interval", "S", defaultSyncInterval, "how often to sync the members of playing sessions, correct any who have drifted and re-measure latencies (never if 0)")
+	flag.DurationVar(&opts.ResumeGrace, "resume-grace", defaultResumeGrace, "how long to keep members who have disconnected in their session in case they resume (never if 0)")
+	flag.DurationVar(&opts.EmptyTTL, "empty-ttl", defaultEmptyTTL, "how long to keep sessions nobody is in, in case somebody joins them again (not at all if 0)")
+	flag.DurationVar(&opts.IdleTimeout, "idle-timeout", defaultIdleTimeout, "how long sessions may go without anybody doing anything in them before they expire (never if 0)")
+	flag.Float64Var(&opts.MinRate, "min-rate", defaultMinRate, "the slowest sessions may be played")
+	flag.Float64Var(&opts.MaxRate, "max-rate", defaultMaxRate, "the fastest sessions may be played")
+	flag.StringVar(&opts.TokenSecret, "token-secret", os.Getenv("FLIXY_TOKEN_SECRET"), "the key to sign invite and session tokens with (random if empty, so that they stop working once the server exits)")
+	flag.StringVarP(&opts.Redis, "redis", "r", os.Getenv("FLIXY_REDIS"), "the address of a redis server to share sessions with other flixy servers through (not shared if empty)")
+	flag.StringVar(&opts.Proxies, "trusted-proxies", os.Getenv("FLIXY_TRUSTED_PROXIES"), "comma-separated addresses or CIDR networks of the proxies in front of the server, whose X-Forwarded-For is trusted (none if empty)")
 	flag.Parse()
 
 	ll, ok := logLevels[opts.LogLevel]
@@ -98,6 +266,98 @@ func init() {
 	log.SetLevel(loglevel)
 	log.Debugf("setting log level to %s", opts.LogLevel)
 
+	f, ok := models.IDFormats[opts.IDFormat]
+	if !ok {
+		log.Errorf("invalid session id format %s set, falling back to default %s", opts.IDFormat, "numeric")
+		f = models.IDFormats["numeric"]
+	}
+	idFormat = f
+
+	policy := models.ControlPolicy(opts.Policy)
+	if !policy.Valid() {
+		log.Errorf("invalid control policy %s set, falling back to default %s", opts.Policy, models.PolicyEveryone)
+		policy = models.PolicyEveryone
+	}
+	models.DefaultControlPolicy = policy
+	models.DefaultAutoPause = opts.AutoPause
+	models.SyncInterval = opts.SyncInterval
+	models.ResumeGrace = opts.ResumeGrace
+	models.EmptyTTL = opts.EmptyTTL
+	models.IdleTimeout = opts.IdleTimeout
+	// Members are banned by whatever address their commands are logged
+	// with.
+	models.RemoteIP = getRemoteIP
+	if proxies, err = parseProxies(opts.Proxies); err != nil {
+		log.Errorf("invalid trusted proxies %s set (%v), falling back to trusting none", opts.Proxies, err)
+	}
+
+	if opts.MinRate <= 0 || opts.MaxRate < opts.MinRate {
+		log.Errorf("invalid playback rates %g-%g set, falling back to default %g-%g", opts.MinRate, opts.MaxRate, models.MinRate, models.MaxRate)
+	} else {
+		models.MinRate = opts.MinRate
+		models.MaxRate = opts.MaxRate
+	}
+
+	if opts.TokenSecret != "" {
+		models.TokenSecret = []byte(opts.TokenSecret)
+	} else if opts.Redis != "" {
+		log.Warn("no token secret set, so invite and session tokens will only work on this server")
+	}
+
+	setupStore()
+}
+
+// setupStore sets up `store` according to `opts`.
+func setupStore() {
+	var ms *models.MemoryStore
+	if opts.Store == "" {
+		ms = models.NewMemoryStore()
+		store = ms
+	} else {
+		fs, err := models.NewFileStore(opts.Store)
+		if err != nil {
+			log.Fatalf("could not load sessions from %s: %v", opts.Store, err)
+		}
+		log.WithField("store_path", opts.Store).Infof("restored %d sessions", len(fs.Records()))
+		ms = fs.MemoryStore
+		store = fs
+		go flushOnExit(fs)
+	}
+
+	if opts.Redis == "" {
+		return
+	}
+
+	b, err := broker.DialRedis(opts.Redis)
+	if err != nil {
+		log.Fatalf("could not connect to redis at %s: %v", opts.Redis, err)
+	}
+	log.WithField("redis", opts.Redis).Info("sharing sessions over redis")
+	if opts.IDFormat == "words" {
+		log.Warn("words session ids are only checked for collisions on this server, and are more likely than other formats to collide with another server's")
+	}
+	ms.UseBus(models.NewBus(b))
+}
+
+// linkPage is shown instead of redirecting to watch URLs which could be
+// anywhere, so that nobody can use flixy's address to send people somewhere
+// they wouldn't otherwise go.
+var linkPage = template.Must(template.New("link").Parse(`<!DOCTYPE html>
+<title>flixy</title>
+<p>You've been invited to watch <a href="{{.}}">{{.}}</a> together.</p>
+`))
+
+// flushOnExit writes the given store's snapshot when the server is told to
+// stop, as it would otherwise lose whatever changed in the last
+// `models.SaveDelay`, and then exits.
+func flushOnExit(fs *models.FileStore) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+
+	fs.Flush()
+	log.WithField("store_path", opts.Store).Info("saved sessions, exiting")
+	os.Exit(0)
 }
 
 // main is the entry point to the flixy server.
@@ -121,7 +381,29 @@ func main() {
 		so.On("flixy pause", PauseHandler(so))
 		so.On("flixy play", PlayHandler(so))
 		so.On("flixy join", JoinHandler(so))
+		so.On("flixy resume", ResumeHandler(so))
 		so.On("flixy seek", SeekHandler(so))
+		so.On("flixy rate", RateHandler(so))
+		so.On("flixy enqueue", EnqueueHandler(so))
+		so.On("flixy reorder", ReorderHandler(so))
+		so.On("flixy dequeue", DequeueHandler(so))
+		so.On("flixy advance", AdvanceHandler(so))
+		so.On("flixy change video", ChangeVideoHandler(so))
+		so.On("flixy set host", SetHostHandler(so))
+		so.On("flixy set policy", SetPolicyHandler(so))
+		so.On("flixy grant", GrantHandler(so))
+		so.On("flixy chat", ChatHandler(so))
+		so.On("flixy annotate", AnnotateHandler(so))
+		so.On("flixy get annotations", GetAnnotationsHandler(so))
+		so.On("flixy member state", MemberStateHandler(so))
+		so.On("flixy set auto pause", SetAutoPauseHandler(so))
+		so.On("flixy pong", PongHandler(so))
+		so.On("flixy create invite", CreateInviteHandler(so))
+		so.On("flixy revoke invite", RevokeInviteHandler(so))
+		so.On("flixy get invites", GetInvitesHandler(so))
+		so.On("flixy kick", KickHandler(so))
+		so.On("flixy ban", BanHandler(so))
+		so.On("flixy nick", NickHandler(so))
 
 		log.WithFields(log.Fields{
 			"member_sockid": sockid,
@@ -134,7 +416,12 @@ func main() {
 		sockid := so.Id()
 		sockip := getRemoteIP(so)
 
-		m, ok := members[sockid]
+		// Disconnect holds on to the member for a while in case they
+		// come back with `flixy resume`. Once they have been gone for
+		// too long they are removed, and if they were the last one,
+		// their session is kept a while longer in case anybody joins
+		// it again before it expires.
+		_, ok := store.Disconnect(sockid)
 		if !ok {
 			log.WithFields(log.Fields{
 				"verb":          "disconnection",
@@ -149,20 +436,6 @@ func main() {
 		}
 
 		log.Infof("%v disconnected", sockid)
-		delete(members, sockid)
-
-		s := m.Session
-
-		// TODO this could be a lot prettier. I wish it could go in the
-		// `RemoveMember` func itself, but I can't actually think of
-		// how to remove a session from within its own context.
-		numLeft := s.RemoveMember(sockid)
-
-		// NOTE what happens if a user connects to the session here?
-		if numLeft == 0 {
-			sid := s.SessionID
-			delete(sessions, sid)
-		}
 	})
 
 	// TODO this should probably go to its own handler, too.
@@ -178,29 +451,85 @@ func main() {
 	api.Get("/status", func(w http.ResponseWriter, r *http.Request) {
 		// print status here
 		// this is just for debugging for now, we need more in-depth stuff soon
-		enc := json.NewEncoder(w)
-		wms := make(map[string]models.WireSession)
-
-		for k, v := range sessions {
-			wms[k] = v.GetWireSession()
+		//
+		// Sessions with a password are left out, so as not to give
+		// them away to anybody who asks.
+		wss := store.WireSessions()
+		for sid, ws := range wss {
+			if ws.Protected {
+				delete(wss, sid)
+			}
 		}
-		enc.Encode(wms)
+
+		enc := json.NewEncoder(w)
+		enc.Encode(wss)
 	})
 
-	// `/sessions/:sid` will 302 the user to the proper Netflix URL if it's
-	// a valid SID, setting the session ID in the URL as it does so. It
-	// will *also* return the session as a JSON object.
+	// `/sessions/:sid` will 302 the user to the proper watch URL if it's
+	// a valid SID, setting the session ID in the URL as it does so, unless
+	// the watch URL could be anywhere. It will *also* return the session
+	// as a JSON object, which has the watch URL in it. Sessions with a
+	// password are treated as if they didn't exist unless a session token
+	// for them is given as `?token=`.
 	api.Get("/sessions/:sid", func(w http.ResponseWriter, r *http.Request) {
 		params := r.URL.Query()
-		session, present := sessions[params.Get(":sid")]
+		session, present := store.Get(params.Get(":sid"))
+		if !present {
+			w.WriteHeader(404)
+			return
+		}
+		if session.Authorize("", models.Credentials{Token: params.Get("token")}) != nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		if session.Redirect() {
+			w.Header().Set("Location", session.WatchURL())
+			w.WriteHeader(302)
+		}
+		routes.ServeJson(w, session.GetWireSession())
+	})
+
+	// `/invite/:token` will 302 the user to the watch URL of the session
+	// an invite is for, setting the invite token in the URL rather than
+	// the session ID, so that the extension joins with the invite, or
+	// show them a link to it if it could be anywhere. It doesn't use the
+	// invite up; only joining does.
+	api.Get("/invite/:token", func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get(":token")
+		inv, err := models.ParseInvite(token)
+		if err == models.ErrInviteExpired {
+			w.WriteHeader(410)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		session, present := store.Get(inv.SessionID)
 		if !present {
 			w.WriteHeader(404)
 			return
 		}
 
-		w.Header().Set("Location", session.GetNetflixURL())
+		switch session.CheckInvite(inv.ID) {
+		case nil:
+		case models.ErrInviteRevoked:
+			w.WriteHeader(404)
+			return
+		default:
+			w.WriteHeader(410)
+			return
+		}
+
+		if !session.Redirect() {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			linkPage.Execute(w, session.InviteURL(token))
+			return
+		}
+		w.Header().Set("Location", session.InviteURL(token))
 		w.WriteHeader(302)
-		routes.ServeJson(w, session.GetWireSession())
 	})
 
 	mux.Handle("/socket.io/", server)
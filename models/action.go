@@ -0,0 +1,63 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// WireAction is the payload of `flixy played`, `flixy paused` and `flixy
+// seeked`, which tell every member of a session who played, paused or seeked
+// it.
+type WireAction struct {
+	MemberID string `json:"member_id"`
+	Nick     string `json:"nick"`
+	// Time is the position of the video, in milliseconds, once the action
+	// had happened, and ServerTime when it happened, as in `WireSession`.
+	Time       int   `json:"time"`
+	ServerTime int64 `json:"server_time"`
+	// From is the position the session was seeked from, for `flixy
+	// seeked`.
+	From int `json:"from,omitempty"`
+	// Seq is the session's sequence number as of the action, which goes
+	// up by one with every action, so that clients can tell which of two
+	// actions came last.
+	Seq int64 `json:"seq"`
+}
+
+// nick returns the nick of the member with the given ID, on this server or
+// another. The caller must hold the session's lock.
+func (s *Session) nick(id string) string {
+	if m, ok := s.Members[id]; ok {
+		return m.Nick
+	}
+	return s.remote[id].Nick
+}
+
+// action bumps the session's sequence number and returns the `WireAction`
+// for something the member with the given ID has just done to it. The caller
+// must hold the session's lock.
+func (s *Session) action(by string) WireAction {
+	now := time.Now()
+	s.seq++
+
+	return WireAction{
+		MemberID:   by,
+		Nick:       s.nick(by),
+		Time:       s.clock.at(now),
+		ServerTime: unixMillis(now),
+		Seq:        s.seq,
+	}
+}
+
+// announce sends the given payload to everyone in the session, on this
+// server and others, as the given event. It must be called without holding
+// the session's lock.
+func (s *Session) announce(event string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		panic("marshaling " + event + " failed: " + err.Error())
+	}
+
+	s.SendToAll(event, payload)
+	s.publish(busMessage{Kind: "action", Event: event, Payload: data})
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// ErrInvalidAnnotation is returned for annotations of an unknown
+	// kind, or with too much or too little text for their kind.
+	ErrInvalidAnnotation = errors.New("invalid annotation")
+
+	// ErrInvalidRange is returned when asking for the annotations of a
+	// time range which ends before it starts.
+	ErrInvalidRange = errors.New("invalid time range")
+)
+
+// AnnotationKind is what sort of thing an annotation is.
+type AnnotationKind string
+
+// These are the kinds of annotation members can make.
+const (
+	// AnnotationReaction is a short reaction, e.g. an emoji.
+	AnnotationReaction AnnotationKind = "reaction"
+	// AnnotationComment is a comment, which may be as long as a chat
+	// message.
+	AnnotationComment AnnotationKind = "comment"
+)
+
+var (
+	// ReactionMaxLength is the most characters a reaction may have.
+	ReactionMaxLength = 32
+
+	// AnnotationLimit is how many annotations each session keeps. Once it
+	// is reached, the oldest are dropped to make room.
+	AnnotationLimit = 1000
+)
+
+// WireAnnotation is a reaction or comment pinned to a point in the video, as
+// sent to members in `flixy annotation` and `flixy annotations`.
+type WireAnnotation struct {
+	ID       string         `json:"id"`
+	MemberID string         `json:"member_id"`
+	Nick     string         `json:"nick"`
+	Kind     AnnotationKind `json:"kind"`
+	Text     string         `json:"text"`
+	// Time is the position in the video the annotation is pinned to, in
+	// milliseconds.
+	Time int `json:"time"`
+	// Created is when the annotation was made, in milliseconds since the
+	// Unix epoch.
+	Created int64 `json:"created"`
+}
+
+// byTime sorts annotations in order of time.
+type byTime []WireAnnotation
+
+func (a byTime) Len() int           { return len(a) }
+func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTime) Less(i, j int) bool { return a[i].Time < a[j].Time }
+
+// validAnnotation returns whether text is acceptable for an annotation of
+// the given kind.
+func validAnnotation(kind AnnotationKind, text string) bool {
+	n := utf8.RuneCountInString(text)
+	switch kind {
+	case AnnotationReaction:
+		return n > 0 && n <= ReactionMaxLength
+	case AnnotationComment:
+		return n > 0 && n <= ChatMaxLength
+	}
+	return false
+}
+
+// Annotate pins a reaction or comment from the member with the given ID to
+// the current time of the session, sending it to everyone in the session on
+// this server and others.
+func (s *Session) Annotate(from string, kind AnnotationKind, text string) (WireAnnotation, error) {
+	text = strings.TrimSpace(text)
+	if !validAnnotation(kind, text) {
+		return WireAnnotation{}, ErrInvalidAnnotation
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return WireAnnotation{}, err
+	}
+
+	now := time.Now()
+
+	s.mu.Lock()
+	m, ok := s.Members[from]
+	if !ok {
+		s.mu.Unlock()
+		return WireAnnotation{}, ErrNotMember
+	}
+	if !m.annotate.allow(now) {
+		s.mu.Unlock()
+		return WireAnnotation{}, ErrRateLimited
+	}
+	s.touch()
+
+	wa := WireAnnotation{
+		ID:       id,
+		MemberID: from,
+		Nick:     m.Nick,
+		Kind:     kind,
+		Text:     text,
+		Time:     s.clock.Now(),
+		Created:  unixMillis(now),
+	}
+	s.addAnnotation(wa)
+	s.mu.Unlock()
+
+	s.persist()
+	s.SendToAll("flixy annotation", wa)
+	s.publish(busMessage{Kind: "annotation", Annotations: []WireAnnotation{wa}})
+
+	return wa, nil
+}
+
+// addAnnotation inserts an annotation into the session's annotations, which
+// are kept in order of time, dropping the oldest annotation if there are too
+// many. The caller must hold the session's lock.
+func (s *Session) addAnnotation(wa WireAnnotation) {
+	i := sort.Search(len(s.annotations), func(i int) bool {
+		return s.annotations[i].Time > wa.Time
+	})
+	s.annotations = append(s.annotations, WireAnnotation{})
+	copy(s.annotations[i+1:], s.annotations[i:])
+	s.annotations[i] = wa
+
+	if len(s.annotations) > AnnotationLimit {
+		oldest := 0
+		for i, a := range s.annotations {
+			if a.Created < s.annotations[oldest].Created {
+				oldest = i
+			}
+		}
+		s.annotations = append(s.annotations[:oldest], s.annotations[oldest+1:]...)
+	}
+}
+
+// Annotations returns the annotations of the session pinned to times between
+// from and to inclusive, in order of time.
+func (s *Session) Annotations(from int, to int) ([]WireAnnotation, error) {
+	if to < from {
+		return nil, ErrInvalidRange
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lo := sort.Search(len(s.annotations), func(i int) bool {
+		return s.annotations[i].Time >= from
+	})
+	hi := sort.Search(len(s.annotations), func(i int) bool {
+		return s.annotations[i].Time > to
+	})
+
+	return append([]WireAnnotation{}, s.annotations[lo:hi]...), nil
+}
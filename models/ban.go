@@ -0,0 +1,189 @@
+package models
+
+import (
+	"crypto/hmac"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/flixy/flixy/Godeps/_workspace/src/github.com/googollee/go-socket.io"
+)
+
+var (
+	// ErrBanned is returned when somebody the host has banned from a
+	// session tries to join it or resume it.
+	ErrBanned = errors.New("banned from session")
+
+	// ErrKickSelf is returned when the host tries to kick or ban
+	// themselves.
+	ErrKickSelf = errors.New("can't kick yourself")
+)
+
+// RemoteIP returns the remote address the given socket is connected from,
+// which is what members are banned by. It only looks at the connection
+// itself unless the server sets it to something which knows which of its
+// proxies to trust.
+var RemoteIP = func(so socketio.Socket) string {
+	return so.Request().RemoteAddr
+}
+
+// Ban is a member who has been banned from a session. Nobody may join the
+// session from their IP address, nor resume with their resume token. Bans
+// are only best-effort: somebody who can connect from another address can
+// still join.
+type Ban struct {
+	MemberID string `json:"member_id"`
+	Nick     string `json:"nick"`
+	IP       string `json:"ip"`
+	Token    string `json:"token"`
+	By       string `json:"by"`
+	// Created is when the member was banned, in milliseconds since the
+	// Unix epoch.
+	Created int64 `json:"created"`
+}
+
+// WireKick is the payload of `flixy kicked`, which is sent to a member when
+// the host kicks or bans them from a session, and of `flixy member kicked`,
+// which is sent to everyone left in it.
+type WireKick struct {
+	SessionID string `json:"session_id"`
+	MemberID  string `json:"member_id"`
+	Nick      string `json:"nick"`
+	By        string `json:"by"`
+	// Ban is whether the member was banned as well as kicked.
+	Ban bool `json:"ban"`
+}
+
+// banIP returns the IP address of the given remote address, without its
+// port, so that it is the same however the member connects next.
+func banIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// banned returns whether somebody connecting from the given remote address,
+// or with the given resume token, is banned from the session. Either may be
+// empty. The caller must hold the session's lock.
+func (s *Session) banned(addr string, token string) bool {
+	ip := banIP(addr)
+	for _, b := range s.bans {
+		if ip != "" && b.IP == ip {
+			return true
+		}
+		if token != "" && hmac.Equal([]byte(b.Token), []byte(token)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ban bans the given member of the session on behalf of the member with the
+// given ID. The caller must hold the session's lock.
+func (s *Session) ban(m *Member, by string) {
+	s.bans[m.ID] = Ban{
+		MemberID: m.ID,
+		Nick:     m.Nick,
+		IP:       banIP(m.ip),
+		Token:    m.token,
+		By:       by,
+		Created:  unixMillis(time.Now()),
+	}
+}
+
+// Kick removes the member with the given ID from the session on behalf of its
+// host, whichever server they are connected to, and tells everyone. If ban
+// is set, they are banned from the session as well.
+func (s *Session) Kick(by string, id string, ban bool) (WireKick, error) {
+	s.mu.Lock()
+	if err := s.hostOnly(by); err != nil {
+		s.mu.Unlock()
+		return WireKick{}, err
+	}
+	if id == by {
+		s.mu.Unlock()
+		return WireKick{}, ErrKickSelf
+	}
+	if !s.hasMember(id) {
+		s.mu.Unlock()
+		return WireKick{}, ErrNoSuchMember
+	}
+
+	wk := WireKick{
+		SessionID: s.SessionID,
+		MemberID:  id,
+		Nick:      s.nick(id),
+		By:        by,
+		Ban:       ban,
+	}
+	m, local := s.Members[id]
+	if local && ban {
+		s.ban(m, by)
+	}
+	s.mu.Unlock()
+
+	if local {
+		s.kicked(m, wk)
+	} else {
+		// Only the server they are connected to knows where they are
+		// connecting from.
+		s.publish(busMessage{Kind: "kick", MemberID: id, Kick: &wk})
+	}
+
+	s.announce("flixy member kicked", wk)
+	return wk, nil
+}
+
+// kicked has the session's store remove the given member of the session,
+// who has just been kicked, persisting their ban first if they were banned.
+// It must be called without holding the session's lock.
+func (s *Session) kicked(m *Member, wk WireKick) {
+	if wk.Ban {
+		s.changed()
+	}
+
+	s.mu.Lock()
+	onKick := s.onKick
+	s.mu.Unlock()
+
+	if onKick != nil {
+		onKick(m, wk)
+	}
+}
+
+// whereabouts returns the given member's socket and whether they are away,
+// if they are still a member of the session.
+func (s *Session) whereabouts(m *Member) (socketio.Socket, bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Members[m.ID] != m {
+		return nil, false, false
+	}
+	return m.Socket, m.away, true
+}
+
+// kick removes the given member from their session, having been kicked from
+// it, and tells them so unless they are away.
+func (st *MemoryStore) kick(m *Member, wk WireKick) {
+	st.mu.Lock()
+	s := m.Session
+	so, away, ok := s.whereabouts(m)
+	if st.sessions[s.SessionID] != s || !ok {
+		st.mu.Unlock()
+		return
+	}
+
+	if st.members[so.Id()] == m {
+		delete(st.members, so.Id())
+	}
+	d := st.remove(m, LeaveKicked)
+	st.mu.Unlock()
+
+	if !away {
+		so.Emit("flixy kicked", wk)
+	}
+	st.departed(d)
+	st.changed()
+}
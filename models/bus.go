@@ -0,0 +1,397 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/flixy/flixy/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/flixy/flixy/broker"
+)
+
+// lookupTimeout is how long `Bus.find` waits for another server to answer
+// for a session before deciding that nobody has it.
+const lookupTimeout = 500 * time.Millisecond
+
+// Bus connects the sessions of this server to the same sessions on every
+// other server sharing its `broker.Broker`.
+//
+// There is no single owner of a session: every server with members in it
+// keeps a replica, and whichever one a play, pause or seek arrives at
+// updates its replica and publishes the resulting state for the others to
+// copy. Clocks are anchored to the wall clock, so the servers' clocks need to
+// agree (i.e. run NTP).
+type Bus struct {
+	broker broker.Broker
+
+	// origin identifies this server, so that it can ignore its own
+	// messages when they come back around.
+	origin string
+}
+
+// busMessage is what is published on a session's channel.
+type busMessage struct {
+	Origin string `json:"origin"`
+
+	// Kind is one of "hello" (asking whoever has the session for its
+	// state), "state", "join", "leave", "member" (a member's state
+	// changing), "kick" (the host kicking a member connected to another
+	// server), "action" (a play, pause, seek or change of video), "chat"
+	// or "annotation".
+	Kind string `json:"kind"`
+
+	State    *SessionRecord        `json:"state,omitempty"`
+	MemberID string                `json:"member_id,omitempty"`
+	Member   *WireMember           `json:"member,omitempty"`
+	Members  map[string]WireMember `json:"members,omitempty"`
+
+	// Chat is the new message of a "chat", or the chat history of a
+	// "state" answering a "hello".
+	Chat []WireChat `json:"chat,omitempty"`
+
+	// Event and Payload are what to send the members of the session for
+	// an "action".
+	Event   string          `json:"event,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// Annotations is the new annotation of an "annotation".
+	Annotations []WireAnnotation `json:"annotations,omitempty"`
+
+	// Kick is who kicked the member of a "kick", and whether they were
+	// banned.
+	Kick *WireKick `json:"kick,omitempty"`
+
+	// Reason is why the member of a "leave" is no longer in the session.
+	Reason LeaveReason `json:"reason,omitempty"`
+}
+
+// NewBus returns a `Bus` publishing and subscribing on the given broker.
+func NewBus(b broker.Broker) *Bus {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic("reading random bytes failed: " + err.Error())
+	}
+
+	return &Bus{b, hex.EncodeToString(id)}
+}
+
+// channel returns the name of the broker channel for the given session ID.
+func (b *Bus) channel(sid string) string {
+	return "flixy:session:" + sid
+}
+
+// find asks the other servers for the session with the given ID, returning a
+// replica of it attached to the bus if one of them answers in time.
+func (b *Bus) find(sid string) (*Session, error) {
+	found := make(chan struct{})
+	s := NewSession(sid, Media{}, 0)
+	s.found = found
+	if err := s.attach(b); err != nil {
+		return nil, err
+	}
+
+	s.publish(busMessage{Kind: "hello"})
+
+	select {
+	case <-found:
+		return s, nil
+	case <-time.After(lookupTimeout):
+		s.detach()
+		return nil, ErrNoSuchSession
+	}
+}
+
+// inbox queues the messages published on a session's channel, so that they
+// are handled in order on a goroutine of the session's own rather than the
+// broker's, which mustn't be held up by anything that takes a lock.
+type inbox struct {
+	mu   sync.Mutex
+	msgs [][]byte
+	wake chan struct{}
+	quit chan struct{}
+}
+
+func newInbox() *inbox {
+	return &inbox{
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+	}
+}
+
+// push queues the given message without blocking.
+func (in *inbox) push(msg []byte) {
+	in.mu.Lock()
+	in.msgs = append(in.msgs, msg)
+	in.mu.Unlock()
+
+	select {
+	case in.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run calls f with every message queued, in order, until the inbox is
+// closed.
+func (in *inbox) run(f func([]byte)) {
+	for {
+		select {
+		case <-in.wake:
+		case <-in.quit:
+			return
+		}
+
+		in.mu.Lock()
+		msgs := in.msgs
+		in.msgs = nil
+		in.mu.Unlock()
+
+		for _, msg := range msgs {
+			f(msg)
+		}
+	}
+}
+
+// close stops `run`, dropping any messages still queued.
+func (in *inbox) close() {
+	close(in.quit)
+}
+
+// attach subscribes the session to its channel on the given bus. The session
+// must not be attached already. It must be called without holding the
+// store's lock, as it waits for the broker.
+func (s *Session) attach(b *Bus) error {
+	in := newInbox()
+	sub, err := b.broker.Subscribe(b.channel(s.SessionID), in.push)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.bus = b
+	s.sub = sub
+	s.inbox = in
+	s.mu.Unlock()
+
+	go in.run(s.receive)
+	return nil
+}
+
+// detach unsubscribes the session from its bus, if it is attached to one.
+func (s *Session) detach() {
+	s.mu.Lock()
+	sub, in := s.sub, s.inbox
+	s.bus = nil
+	s.sub = nil
+	s.inbox = nil
+	s.mu.Unlock()
+
+	if sub != nil {
+		sub.Unsubscribe()
+	}
+	if in != nil {
+		in.close()
+	}
+}
+
+// publish sends the given message to the other servers, if the session is
+// attached to a bus. It must be called without holding the session's lock.
+func (s *Session) publish(msg busMessage) {
+	s.mu.Lock()
+	b := s.bus
+	s.mu.Unlock()
+
+	if b == nil {
+		return
+	}
+
+	msg.Origin = b.origin
+	data, err := json.Marshal(msg)
+	if err != nil {
+		panic("marshaling bus message failed: " + err.Error())
+	}
+
+	if err := b.broker.Publish(b.channel(s.SessionID), data); err != nil {
+		log.WithField("session_id", s.SessionID).Error(err)
+	}
+}
+
+// publishState sends the current state of the session, along with the
+// members connected to this server, to the other servers.
+func (s *Session) publishState() {
+	s.publish(s.stateMessage())
+}
+
+// stateMessage returns the "state" message for the session as it is now.
+func (s *Session) stateMessage() busMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.record()
+	// Annotations only change by "annotation", so they are only sent
+	// along to replicas that have only just been created.
+	r.Annotations = nil
+	wms := make(map[string]WireMember, len(s.Members))
+	for k, m := range s.Members {
+		wms[k] = m.ToWireMember()
+	}
+
+	return busMessage{Kind: "state", State: &r, Members: wms}
+}
+
+// receive handles a message published on the session's channel.
+func (s *Session) receive(data []byte) {
+	var msg busMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.WithField("session_id", s.SessionID).Error(err)
+		return
+	}
+
+	s.mu.Lock()
+	if s.bus == nil || msg.Origin == s.bus.origin {
+		s.mu.Unlock()
+		return
+	}
+
+	switch msg.Kind {
+	case "hello":
+		s.mu.Unlock()
+		// Don't answer with a replica that is itself still waiting
+		// to hear what the state is.
+		if !s.isFound() {
+			return
+		}
+		// A replica that's only just been created needs the
+		// chat history and annotations as well, which aren't
+		// worth sending around with every other change of
+		// state.
+		msg := s.stateMessage()
+		msg.Chat = s.ChatHistory()
+		msg.State.Annotations, _ = s.Annotations(math.MinInt32, math.MaxInt32)
+		s.publish(msg)
+		return
+
+	case "state":
+		if msg.State != nil {
+			s.apply(*msg.State)
+		}
+		for k, wm := range msg.Members {
+			s.remote[k] = wm
+		}
+		if s.found != nil {
+			s.chat = msg.Chat
+			close(s.found)
+			s.found = nil
+		}
+		s.mu.Unlock()
+
+		s.persist()
+		s.scheduleEnd()
+		s.Sync()
+		return
+
+	case "join":
+		if msg.Member == nil {
+			break
+		}
+		s.remote[msg.MemberID] = *msg.Member
+		s.mu.Unlock()
+
+		s.SendToAll("flixy member joined", WireMemberJoined{
+			SessionID: s.SessionID,
+			Member:    *msg.Member,
+		})
+		return
+
+	case "leave":
+		wml := WireMemberLeft{
+			SessionID: s.SessionID,
+			MemberID:  msg.MemberID,
+			Nick:      s.remote[msg.MemberID].Nick,
+			Reason:    msg.Reason,
+		}
+		if msg.Member != nil {
+			wml.Nick = msg.Member.Nick
+		}
+		if wml.Reason == "" {
+			wml.Reason = LeaveLeft
+		}
+		delete(s.remote, msg.MemberID)
+		s.mu.Unlock()
+
+		// Whoever kicked them has told everyone already.
+		if wml.Reason != LeaveKicked {
+			s.SendToAll("flixy member left", wml)
+		}
+		return
+
+	case "member":
+		if msg.Member == nil {
+			break
+		}
+		s.remote[msg.MemberID] = *msg.Member
+		s.mu.Unlock()
+
+		// Whoever it was that changed state has already paused or
+		// resumed the session if need be, and will send the state
+		// along separately.
+		s.Sync()
+		return
+
+	case "kick":
+		m, ok := s.Members[msg.MemberID]
+		if !ok || msg.Kick == nil {
+			break
+		}
+		if msg.Kick.Ban {
+			s.ban(m, msg.Kick.By)
+		}
+		s.mu.Unlock()
+
+		s.kicked(m, *msg.Kick)
+		return
+
+	case "action":
+		s.mu.Unlock()
+		if msg.Payload != nil {
+			s.SendToAll(msg.Event, msg.Payload)
+		}
+		return
+
+	case "annotation":
+		for _, wa := range msg.Annotations {
+			s.addAnnotation(wa)
+		}
+		s.mu.Unlock()
+
+		s.persist()
+		for _, wa := range msg.Annotations {
+			s.SendToAll("flixy annotation", wa)
+		}
+		return
+
+	case "chat":
+		for _, wc := range msg.Chat {
+			s.addChat(wc)
+		}
+		s.mu.Unlock()
+
+		s.persist()
+		for _, wc := range msg.Chat {
+			s.SendToAll("flixy chat", wc)
+		}
+		return
+	}
+	s.mu.Unlock()
+}
+
+// isFound returns whether the session knows its state, which a replica
+// created by `Bus.find` only does once another server has told it.
+func (s *Session) isFound() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.found == nil
+}
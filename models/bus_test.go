@@ -0,0 +1,108 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/flixy/flixy/broker"
+)
+
+// slowBroker is a `broker.Broker` whose subscriptions wait to be let through.
+type slowBroker struct {
+	*broker.Local
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *slowBroker) Subscribe(channel string, f func([]byte)) (broker.Subscription, error) {
+	b.entered <- struct{}{}
+	<-b.release
+	return b.Local.Subscribe(channel, f)
+}
+
+// eventually fails the test if ok doesn't become true within a second.
+func eventually(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestCreateSubscribesUnlocked checks that the store can be used while a
+// session being created waits for its subscription.
+func TestCreateSubscribesUnlocked(t *testing.T) {
+	st := newTestStore(t)
+	b := &slowBroker{broker.NewLocal(), make(chan struct{}), make(chan struct{})}
+	st.UseBus(NewBus(b))
+
+	created := make(chan error)
+	go func() {
+		_, err := st.Create("1", NetflixMedia(80018499), 0, newFakeSocket("a"), "alice", SessionOptions{})
+		created <- err
+	}()
+	<-b.entered
+
+	got := make(chan struct{})
+	go func() {
+		st.Get("2")
+		close(got)
+	}()
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Error("store was locked while subscribing")
+	}
+
+	close(b.release)
+	if err := <-created; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBusKickWhileStoreLocked checks that delivering a kick from another
+// server doesn't wait for the store's lock, which the broker mustn't do.
+func TestBusKickWhileStoreLocked(t *testing.T) {
+	st := newTestStore(t)
+	b := broker.NewLocal()
+	st.UseBus(NewBus(b))
+
+	if _, err := st.Create("1", NetflixMedia(80018499), 0, newFakeSocket("a"), "alice", SessionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	bob := newFakeSocket("b")
+	if _, err := st.Join("1", bob, "bob", Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(busMessage{
+		Origin:   "elsewhere",
+		Kind:     "kick",
+		MemberID: "b",
+		Kick:     &WireKick{SessionID: "1", MemberID: "b", Nick: "bob", By: "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st.mu.Lock()
+	delivered := make(chan struct{})
+	go func() {
+		b.Publish("flixy:session:1", data)
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Error("delivering the kick waited for the store's lock")
+	}
+	st.mu.Unlock()
+	<-delivered
+
+	eventually(t, "bob to be kicked", func() bool { return bob.sent("flixy kicked") == 1 })
+}
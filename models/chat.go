@@ -0,0 +1,143 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// ErrEmptyChat is returned for chat messages with nothing in them.
+	ErrEmptyChat = errors.New("chat message is empty")
+
+	// ErrChatTooLong is returned for chat messages longer than
+	// `ChatMaxLength`.
+	ErrChatTooLong = errors.New("chat message is too long")
+
+	// ErrRateLimited is returned when a member sends chat messages faster
+	// than `ChatBurst` and `ChatInterval` allow, or passwords are tried
+	// faster than `PasswordBurst` and `PasswordInterval` do.
+	ErrRateLimited = errors.New("sending too fast")
+)
+
+var (
+	// ChatMaxLength is the most characters a chat message may have.
+	ChatMaxLength = 500
+
+	// ChatHistoryLength is how many chat messages each session keeps
+	// around to replay to members who join later.
+	ChatHistoryLength = 100
+
+	// ChatBurst is how many chat messages a member may send in a row
+	// before being rate limited.
+	ChatBurst = 5
+
+	// ChatInterval is how often a rate limited member earns another chat
+	// message, up to `ChatBurst`.
+	ChatInterval = 2 * time.Second
+)
+
+// WireChat is a chat message as sent to members in `flixy chat` and
+// `flixy chat history`.
+type WireChat struct {
+	MemberID string `json:"member_id"`
+	Nick     string `json:"nick"`
+	Text     string `json:"text"`
+	// Time is when the server received the message, in milliseconds since
+	// the Unix epoch.
+	Time int64 `json:"time"`
+}
+
+// chatLimiter is a token bucket limiting how fast a member may chat.
+type chatLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket if there is one, returning whether
+// there was.
+func (l *chatLimiter) allow(now time.Time) bool {
+	return l.allowAt(now, ChatBurst, ChatInterval)
+}
+
+// allowAt is `allow` for a bucket holding burst tokens, which earns another
+// every interval.
+func (l *chatLimiter) allowAt(now time.Time, burst int, interval time.Duration) bool {
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	} else {
+		l.tokens += float64(now.Sub(l.last)) / float64(interval)
+		if l.tokens > float64(burst) {
+			l.tokens = float64(burst)
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Chat sends a chat message from the member with the given ID to everyone in
+// the session, on this server and others, and keeps it in the session's
+// history.
+func (s *Session) Chat(from string, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ErrEmptyChat
+	}
+	if utf8.RuneCountInString(text) > ChatMaxLength {
+		return ErrChatTooLong
+	}
+
+	now := time.Now()
+
+	s.mu.Lock()
+	m, ok := s.Members[from]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotMember
+	}
+	if !m.chat.allow(now) {
+		s.mu.Unlock()
+		return ErrRateLimited
+	}
+	s.touch()
+
+	wc := WireChat{
+		MemberID: from,
+		Nick:     m.Nick,
+		Text:     text,
+		Time:     unixMillis(now),
+	}
+	s.addChat(wc)
+	s.mu.Unlock()
+
+	s.persist()
+	s.SendToAll("flixy chat", wc)
+	s.publish(busMessage{Kind: "chat", Chat: []WireChat{wc}})
+
+	return nil
+}
+
+// addChat appends a chat message to the session's history, dropping the
+// oldest message if the history is full. The caller must hold the session's
+// lock.
+func (s *Session) addChat(wc WireChat) {
+	s.chat = append(s.chat, wc)
+	if over := len(s.chat) - ChatHistoryLength; over > 0 {
+		s.chat = append([]WireChat(nil), s.chat[over:]...)
+	}
+	s.chatCount++
+}
+
+// ChatHistory returns the chat messages the session has kept, oldest first.
+func (s *Session) ChatHistory() []WireChat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]WireChat{}, s.chat...)
+}
@@ -0,0 +1,90 @@
+package models
+
+import "time"
+
+// clock is the playback clock of a session. Rather than counting
+// milliseconds on a ticker, it remembers the position of the video at a
+// given wall-clock instant (the anchor) and derives the current position
+// from how much wall-clock time has passed since then.
+type clock struct {
+	// pos is the position of the video, in milliseconds, at `anchor`.
+	pos int
+	// anchor is the wall-clock instant at which the video was at `pos`,
+	// which is also when the clock was last seeked, played, paused or
+	// had its rate changed.
+	anchor time.Time
+	// rate is how many milliseconds of video pass per millisecond of
+	// wall-clock time while playing.
+	rate   float64
+	paused bool
+}
+
+// newClock returns a paused clock positioned at the given timestamp.
+func newClock(ts int) *clock {
+	return &clock{
+		pos:    ts,
+		anchor: time.Now(),
+		rate:   1,
+		paused: true,
+	}
+}
+
+// at returns the position of the video, in milliseconds, at the given
+// wall-clock instant.
+func (c *clock) at(t time.Time) int {
+	if c.paused {
+		return c.pos
+	}
+
+	elapsed := float64(t.Sub(c.anchor)) / float64(time.Millisecond)
+	return c.pos + int(elapsed*c.rate)
+}
+
+// anchoredSince returns whether the clock has been seeked, played, paused or
+// had its rate changed since the given instant, so that a position the video
+// was at then has nothing to do with where it is now.
+func (c *clock) anchoredSince(t time.Time) bool {
+	return !c.anchor.Before(t)
+}
+
+// Now returns the current position of the video, in milliseconds.
+func (c *clock) Now() int {
+	return c.at(time.Now())
+}
+
+// reanchor moves the anchor to the current instant, carrying over the
+// position so that it can be changed without losing elapsed time.
+func (c *clock) reanchor() {
+	now := time.Now()
+	c.pos = c.at(now)
+	c.anchor = now
+}
+
+// Set sets the position of the video to the given timestamp.
+func (c *clock) Set(ts int) {
+	c.pos = ts
+	c.anchor = time.Now()
+}
+
+// Play starts the clock advancing from its current position.
+func (c *clock) Play() {
+	c.reanchor()
+	c.paused = false
+}
+
+// Pause stops the clock at its current position.
+func (c *clock) Pause() {
+	c.reanchor()
+	c.paused = true
+}
+
+// SetRate changes how fast the clock advances from its current position.
+func (c *clock) SetRate(rate float64) {
+	c.reanchor()
+	c.rate = rate
+}
+
+// Paused returns whether or not the clock is currently stopped.
+func (c *clock) Paused() bool {
+	return c.paused
+}
@@ -0,0 +1,223 @@
+package models
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	// ErrNotMember is returned when a socket tries to control a session
+	// it is not a member of.
+	ErrNotMember = errors.New("not a member of this session")
+
+	// ErrForbidden is returned when a member tries to do something the
+	// session's control policy does not allow them to.
+	ErrForbidden = errors.New("not allowed to control this session")
+
+	// ErrNotHost is returned when a member other than the host tries to
+	// do something only the host may do.
+	ErrNotHost = errors.New("only the host may do that")
+
+	// ErrNoSuchMember is returned when a command refers to a member who
+	// is not in the session.
+	ErrNoSuchMember = errors.New("no such member")
+
+	// ErrInvalidPolicy is returned for control policies flixy doesn't
+	// know about.
+	ErrInvalidPolicy = errors.New("invalid control policy")
+)
+
+// ControlPolicy decides which members of a session may play, pause and seek
+// it.
+type ControlPolicy string
+
+// These are the control policies a session can have.
+const (
+	// PolicyEveryone lets every member control the session.
+	PolicyEveryone ControlPolicy = "everyone"
+	// PolicyHost only lets the host control the session.
+	PolicyHost ControlPolicy = "host"
+	// PolicyGrants lets the host and the members the host has granted
+	// control to control the session.
+	PolicyGrants ControlPolicy = "grants"
+)
+
+// DefaultControlPolicy is the control policy of new sessions which don't ask
+// for a particular one.
+var DefaultControlPolicy = PolicyEveryone
+
+// Valid returns whether the policy is one flixy knows about.
+func (p ControlPolicy) Valid() bool {
+	switch p {
+	case PolicyEveryone, PolicyHost, PolicyGrants:
+		return true
+	}
+	return false
+}
+
+// Host returns the ID of the session's host.
+func (s *Session) Host() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.host
+}
+
+// hasMember returns whether the member with the given ID is in the session,
+// on this server or another. The caller must hold the session's lock.
+func (s *Session) hasMember(id string) bool {
+	if _, ok := s.Members[id]; ok {
+		return true
+	}
+	_, ok := s.remote[id]
+	return ok
+}
+
+// canControl returns why the member with the given ID may not control the
+// session, if they may not. The caller must hold the session's lock.
+func (s *Session) canControl(id string) error {
+	if !s.hasMember(id) {
+		return ErrNotMember
+	}
+
+	switch {
+	case id == s.host:
+		return nil
+	case s.policy == PolicyEveryone:
+		return nil
+	case s.policy == PolicyGrants && s.grants[id]:
+		return nil
+	}
+	return ErrForbidden
+}
+
+// CanControl returns `ErrNotMember` if the member with the given ID is not in
+// the session, or `ErrForbidden` if the session's control policy doesn't let
+// them play, pause or seek it.
+func (s *Session) CanControl(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.canControl(id)
+}
+
+// hostOnly returns why the member with the given ID may not do something only
+// the host may do, if they may not. The caller must hold the session's lock.
+func (s *Session) hostOnly(id string) error {
+	if !s.hasMember(id) {
+		return ErrNotMember
+	}
+	if id != s.host {
+		return ErrNotHost
+	}
+	return nil
+}
+
+// SetHost makes the member with the given ID the host of the session, on
+// behalf of the current host.
+func (s *Session) SetHost(by string, id string) error {
+	s.mu.Lock()
+	if err := s.hostOnly(by); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if !s.hasMember(id) {
+		s.mu.Unlock()
+		return ErrNoSuchMember
+	}
+	s.host = id
+	s.version++
+	s.mu.Unlock()
+
+	s.changed()
+	s.Sync()
+	return nil
+}
+
+// SetPolicy sets the control policy of the session, on behalf of its host.
+func (s *Session) SetPolicy(by string, p ControlPolicy) error {
+	if !p.Valid() {
+		return ErrInvalidPolicy
+	}
+
+	s.mu.Lock()
+	if err := s.hostOnly(by); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.policy = p
+	s.version++
+	s.mu.Unlock()
+
+	s.changed()
+	s.Sync()
+	return nil
+}
+
+// Grant grants or revokes control of the session to the member with the
+// given ID, on behalf of the session's host. Grants only matter under
+// `PolicyGrants`.
+func (s *Session) Grant(by string, id string, control bool) error {
+	s.mu.Lock()
+	if err := s.hostOnly(by); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if !s.hasMember(id) {
+		s.mu.Unlock()
+		return ErrNoSuchMember
+	}
+	if control {
+		s.grants[id] = true
+	} else {
+		delete(s.grants, id)
+	}
+	s.version++
+	s.mu.Unlock()
+
+	s.changed()
+	s.Sync()
+	return nil
+}
+
+// handOff picks a new host for the session if its host is no longer in it,
+// returning whether it did. Members connected to this server are preferred,
+// longest-standing first and those who are away last, then those connected to
+// other servers. The caller must hold the session's lock.
+func (s *Session) handOff() bool {
+	if s.host != "" && s.hasMember(s.host) {
+		return false
+	}
+
+	var next *Member
+	for _, m := range s.Members {
+		switch {
+		case next == nil:
+			next = m
+		case m.away != next.away:
+			if !m.away {
+				next = m
+			}
+		case m.joined.Before(next.joined):
+			next = m
+		}
+	}
+	if next != nil {
+		s.host = next.ID
+		s.version++
+		return true
+	}
+
+	ids := make([]string, 0, len(s.remote))
+	for id := range s.remote {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		s.host = ""
+		return false
+	}
+	sort.Strings(ids)
+	s.host = ids[0]
+	s.version++
+	return true
+}
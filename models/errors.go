@@ -0,0 +1,179 @@
+package models
+
+import "errors"
+
+// ErrInvalidVideoID is returned for messages which should say which video to
+// watch, but don't.
+var ErrInvalidVideoID = errors.New("invalid video id")
+
+// ErrorCode is the machine-readable reason a client's command was rejected.
+type ErrorCode string
+
+// These are the codes a `WireError` can have.
+const (
+	// ErrCodeBadJSON means the message could not be parsed.
+	ErrCodeBadJSON ErrorCode = "bad_json"
+	// ErrCodeInvalidSessionID means the session ID was not of any shape
+	// flixy generates.
+	ErrCodeInvalidSessionID ErrorCode = "invalid_session_id"
+	// ErrCodeNoSuchSession means the session ID was well-formed, but
+	// there is no such session.
+	ErrCodeNoSuchSession ErrorCode = "no_such_session"
+	// ErrCodeSessionExists means no session ID which wasn't already in
+	// use could be found for a new session.
+	ErrCodeSessionExists ErrorCode = "session_exists"
+	// ErrCodeInvalidVideoID means the command was sent without a video.
+	ErrCodeInvalidVideoID ErrorCode = "invalid_video_id"
+	// ErrCodeInvalidMedia means the media's provider is not one flixy
+	// knows about, or its ID is not one that provider could have given
+	// out.
+	ErrCodeInvalidMedia ErrorCode = "invalid_media"
+	// ErrCodeInvalidPolicy means the control policy is not one flixy
+	// knows about.
+	ErrCodeInvalidPolicy ErrorCode = "invalid_policy"
+	// ErrCodeNotMember means the command can only be sent by members of
+	// the session.
+	ErrCodeNotMember ErrorCode = "not_member"
+	// ErrCodeForbidden means the session's control policy does not let
+	// the member play, pause or seek it.
+	ErrCodeForbidden ErrorCode = "forbidden"
+	// ErrCodeNotHost means the command can only be sent by the host.
+	ErrCodeNotHost ErrorCode = "not_host"
+	// ErrCodeNoSuchMember means the member the command refers to is not
+	// in the session.
+	ErrCodeNoSuchMember ErrorCode = "no_such_member"
+	// ErrCodeEmptyChat means the chat message had nothing in it.
+	ErrCodeEmptyChat ErrorCode = "empty_chat"
+	// ErrCodeChatTooLong means the chat message was too long.
+	ErrCodeChatTooLong ErrorCode = "chat_too_long"
+	// ErrCodeRateLimited means the member is sending chat messages too
+	// fast.
+	ErrCodeRateLimited ErrorCode = "rate_limited"
+	// ErrCodeInvalidAnnotation means the annotation was of an unknown
+	// kind, or had too much or too little text for its kind.
+	ErrCodeInvalidAnnotation ErrorCode = "invalid_annotation"
+	// ErrCodeInvalidRange means the time range ended before it started.
+	ErrCodeInvalidRange ErrorCode = "invalid_range"
+	// ErrCodeInvalidMemberState means the member state is not one flixy
+	// knows about.
+	ErrCodeInvalidMemberState ErrorCode = "invalid_member_state"
+	// ErrCodeInvalidPong means the pong did not answer a ping the member
+	// was sent and hadn't answered yet.
+	ErrCodeInvalidPong ErrorCode = "invalid_pong"
+	// ErrCodeConflict means somebody else changed the session since the
+	// version the command was based on.
+	ErrCodeConflict ErrorCode = "conflict"
+	// ErrCodeInvalidRate means the playback rate was not positive.
+	ErrCodeInvalidRate ErrorCode = "invalid_rate"
+	// ErrCodeQueueFull means the session's queue has as many videos in it
+	// as it may.
+	ErrCodeQueueFull ErrorCode = "queue_full"
+	// ErrCodeQueueEmpty means there is nothing queued up to advance to.
+	ErrCodeQueueEmpty ErrorCode = "queue_empty"
+	// ErrCodeNoSuchItem means the video the command refers to is not in
+	// the session's queue.
+	ErrCodeNoSuchItem ErrorCode = "no_such_item"
+	// ErrCodeInvalidInvite means the invite token was not signed by
+	// flixy, or the invite asked for was nonsensical.
+	ErrCodeInvalidInvite ErrorCode = "invalid_invite"
+	// ErrCodeInviteExpired means the invite has expired.
+	ErrCodeInviteExpired ErrorCode = "invite_expired"
+	// ErrCodeInviteUsedUp means the invite has been used as many times
+	// as it may be.
+	ErrCodeInviteUsedUp ErrorCode = "invite_used_up"
+	// ErrCodeInviteRevoked means the host has revoked the invite.
+	ErrCodeInviteRevoked ErrorCode = "invite_revoked"
+	// ErrCodeTooManyInvites means the session has as many outstanding
+	// invites as it may.
+	ErrCodeTooManyInvites ErrorCode = "too_many_invites"
+	// ErrCodePasswordRequired means the session has a password, which
+	// was not given.
+	ErrCodePasswordRequired ErrorCode = "password_required"
+	// ErrCodeWrongPassword means the password or session token given was
+	// not the session's.
+	ErrCodeWrongPassword ErrorCode = "wrong_password"
+	// ErrCodeInvalidResumeToken means the resume token was not that of
+	// the member being resumed.
+	ErrCodeInvalidResumeToken ErrorCode = "invalid_resume_token"
+	// ErrCodeBanned means the host has banned whoever sent the command
+	// from the session.
+	ErrCodeBanned ErrorCode = "banned"
+	// ErrCodeKickSelf means the host tried to kick or ban themselves.
+	ErrCodeKickSelf ErrorCode = "kick_self"
+	// ErrCodeInvalidNick means the nick had nothing in it.
+	ErrCodeInvalidNick ErrorCode = "invalid_nick"
+	// ErrCodeNickTooLong means the nick was too long.
+	ErrCodeNickTooLong ErrorCode = "nick_too_long"
+	// ErrCodeInternal means something went wrong on the server's end.
+	ErrCodeInternal ErrorCode = "internal"
+)
+
+// errorCodes maps the errors of this package to the codes they are reported
+// to clients with.
+var errorCodes = map[error]ErrorCode{
+	ErrInvalidSessionID:   ErrCodeInvalidSessionID,
+	ErrNoSuchSession:      ErrCodeNoSuchSession,
+	ErrSessionExists:      ErrCodeSessionExists,
+	ErrInvalidVideoID:     ErrCodeInvalidVideoID,
+	ErrInvalidMedia:       ErrCodeInvalidMedia,
+	ErrInvalidPolicy:      ErrCodeInvalidPolicy,
+	ErrNotMember:          ErrCodeNotMember,
+	ErrForbidden:          ErrCodeForbidden,
+	ErrNotHost:            ErrCodeNotHost,
+	ErrNoSuchMember:       ErrCodeNoSuchMember,
+	ErrEmptyChat:          ErrCodeEmptyChat,
+	ErrChatTooLong:        ErrCodeChatTooLong,
+	ErrRateLimited:        ErrCodeRateLimited,
+	ErrInvalidAnnotation:  ErrCodeInvalidAnnotation,
+	ErrInvalidRange:       ErrCodeInvalidRange,
+	ErrInvalidMemberState: ErrCodeInvalidMemberState,
+	ErrInvalidPong:        ErrCodeInvalidPong,
+	ErrConflict:           ErrCodeConflict,
+	ErrInvalidRate:        ErrCodeInvalidRate,
+	ErrQueueFull:          ErrCodeQueueFull,
+	ErrQueueEmpty:         ErrCodeQueueEmpty,
+	ErrNoSuchItem:         ErrCodeNoSuchItem,
+	ErrInvalidInvite:      ErrCodeInvalidInvite,
+	ErrInviteExpired:      ErrCodeInviteExpired,
+	ErrInviteUsedUp:       ErrCodeInviteUsedUp,
+	ErrInviteRevoked:      ErrCodeInviteRevoked,
+	ErrTooManyInvites:     ErrCodeTooManyInvites,
+	ErrPasswordRequired:   ErrCodePasswordRequired,
+	ErrWrongPassword:      ErrCodeWrongPassword,
+	ErrInvalidResumeToken: ErrCodeInvalidResumeToken,
+	ErrBanned:             ErrCodeBanned,
+	ErrKickSelf:           ErrCodeKickSelf,
+	ErrInvalidNick:        ErrCodeInvalidNick,
+	ErrNickTooLong:        ErrCodeNickTooLong,
+}
+
+// CodeOf returns the `ErrorCode` a given error is reported to clients with.
+// Errors which are not from this package are internal errors.
+func CodeOf(err error) ErrorCode {
+	if code, ok := errorCodes[err]; ok {
+		return code
+	}
+	return ErrCodeInternal
+}
+
+// WireError is the payload of `flixy error`, which is sent to a client
+// whenever one of its commands is rejected.
+type WireError struct {
+	Code ErrorCode `json:"code"`
+	// Verb is the command which was rejected, e.g. "flixy seek".
+	Verb string `json:"verb"`
+	// RequestID is the `request_id` the client sent with the command, if
+	// any.
+	RequestID string `json:"request_id,omitempty"`
+	// Message is a human-readable description of the error.
+	Message string `json:"message"`
+}
+
+// Ack is what every command is acknowledged with, if the client asked for a
+// socket.io acknowledgement.
+type Ack struct {
+	OK        bool       `json:"ok"`
+	Verb      string     `json:"verb"`
+	RequestID string     `json:"request_id,omitempty"`
+	Error     *WireError `json:"error,omitempty"`
+}
@@ -0,0 +1,318 @@
+package models
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/flixy/flixy/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+// SessionRecord is the persisted representation of a session. Sockets can't
+// survive a restart, so only the nicks of its members are kept; they have to
+// `flixy join` the session again once the server is back.
+type SessionRecord struct {
+	SessionID string `json:"session_id"`
+	Media     Media  `json:"media"`
+
+	// VideoID is the Netflix video ID sessions were saved with before
+	// flixy knew about `Media`, and is only read, never written.
+	VideoID int `json:"video_id,omitempty"`
+
+	// Time is the position of the video, in milliseconds, at AnchoredAt.
+	// Because the clock is anchored to the wall clock, a playing session
+	// has carried on playing while the server was down.
+	Time       int       `json:"time"`
+	AnchoredAt time.Time `json:"anchored_at"`
+	Rate       float64   `json:"rate"`
+	Paused     bool      `json:"paused"`
+
+	Duration int             `json:"duration"`
+	Queue    []WireQueueItem `json:"queue"`
+
+	Host   string        `json:"host"`
+	Policy ControlPolicy `json:"policy"`
+	Grants []string      `json:"grants"`
+
+	AutoPause bool `json:"auto_pause"`
+	Held      bool `json:"held"`
+
+	ChatCount int   `json:"chat_count"`
+	Seq       int64 `json:"seq"`
+	Version   int64 `json:"version"`
+
+	Invites []WireInvite `json:"invites"`
+
+	// Password is the salted hash of the session's password, never the
+	// password itself.
+	Password []byte `json:"password"`
+	Salt     []byte `json:"salt"`
+
+	Bans []Ban `json:"bans"`
+
+	// Annotations are left out of the records sent between servers with
+	// every change of state, in which case they are nil.
+	Annotations []WireAnnotation `json:"annotations"`
+
+	Nicks []string `json:"nicks"`
+}
+
+// record returns the `SessionRecord` of a session. The caller must hold the
+// session's lock.
+func (s *Session) record() SessionRecord {
+	nicks := make([]string, 0, len(s.Members))
+	for _, m := range s.Members {
+		nicks = append(nicks, m.Nick)
+	}
+
+	grants := make([]string, 0, len(s.grants))
+	for id := range s.grants {
+		grants = append(grants, id)
+	}
+
+	invites := make([]WireInvite, 0, len(s.invites))
+	for _, wi := range s.invites {
+		invites = append(invites, wi)
+	}
+
+	bans := make([]Ban, 0, len(s.bans))
+	for _, b := range s.bans {
+		bans = append(bans, b)
+	}
+
+	return SessionRecord{
+		SessionID:   s.SessionID,
+		Media:       s.Media,
+		Time:        s.clock.pos,
+		AnchoredAt:  s.clock.anchor,
+		Rate:        s.clock.rate,
+		Paused:      s.clock.paused,
+		Duration:    s.duration,
+		Queue:       append([]WireQueueItem{}, s.queue...),
+		Host:        s.host,
+		Policy:      s.policy,
+		Grants:      grants,
+		AutoPause:   s.autoPause,
+		Held:        s.held,
+		ChatCount:   s.chatCount,
+		Seq:         s.seq,
+		Version:     s.version,
+		Invites:     invites,
+		Password:    s.password,
+		Salt:        s.salt,
+		Bans:        bans,
+		Annotations: append([]WireAnnotation{}, s.annotations...),
+		Nicks:       nicks,
+	}
+}
+
+// apply sets the state of the session to that of the given record. The
+// caller must hold the session's lock.
+func (s *Session) apply(r SessionRecord) {
+	// Whatever changed, somebody did it, if only on another server.
+	s.touch()
+
+	s.Media = r.Media
+	if s.Media == (Media{}) && r.VideoID != 0 {
+		s.Media = NetflixMedia(r.VideoID)
+	}
+	s.clock.pos = r.Time
+	s.clock.anchor = r.AnchoredAt
+	s.clock.paused = r.Paused
+	if r.Rate > 0 {
+		s.clock.rate = r.Rate
+	}
+
+	s.duration = r.Duration
+	s.queue = append([]WireQueueItem(nil), r.Queue...)
+
+	s.host = r.Host
+	if r.Policy.Valid() {
+		s.policy = r.Policy
+	}
+	s.grants = make(map[string]bool, len(r.Grants))
+	for _, id := range r.Grants {
+		s.grants[id] = true
+	}
+
+	s.autoPause = r.AutoPause
+	s.held = r.Held
+
+	s.chatCount = r.ChatCount
+	// Two servers may have changed the session at once, so only ever
+	// count upwards.
+	if r.Seq > s.seq {
+		s.seq = r.Seq
+	}
+	if r.Version > s.version {
+		s.version = r.Version
+	}
+
+	invites := make(map[string]WireInvite, len(r.Invites))
+	for _, wi := range r.Invites {
+		if old, ok := s.invites[wi.ID]; ok && old.Uses > wi.Uses {
+			wi.Uses = old.Uses
+		}
+		invites[wi.ID] = wi
+	}
+	s.invites = invites
+
+	s.password = r.Password
+	s.salt = r.Salt
+
+	// Bans are never lifted, and two servers may have banned somebody at
+	// once, so they are only ever added to.
+	for _, b := range r.Bans {
+		s.bans[b.MemberID] = b
+	}
+
+	if r.Annotations != nil {
+		s.annotations = append([]WireAnnotation{}, r.Annotations...)
+		sort.Sort(byTime(s.annotations))
+	}
+}
+
+// sessionFromRecord rebuilds a memberless session from its record.
+func sessionFromRecord(r SessionRecord) *Session {
+	s := NewSession(r.SessionID, r.Media, r.Time)
+	s.apply(r)
+
+	return s
+}
+
+// SaveDelay is how long a `FileStore` waits after something changes before
+// writing its snapshot, so that a burst of changes (e.g. a flurry of chat) is
+// written once rather than every time.
+var SaveDelay = time.Second
+
+// FileStore is a `SessionStore` which keeps everything in memory like a
+// `MemoryStore`, but also writes a JSON snapshot of every session to a file
+// shortly after anything changes, and reloads it when created, so that
+// sessions survive a server restart. Whatever changed within `SaveDelay` of
+// the server going down without a `Flush` is lost.
+//
+// Sessions reloaded from the snapshot have no members until somebody joins
+// them, and expire as usual if nobody does within `EmptyTTL`.
+type FileStore struct {
+	*MemoryStore
+	path string
+
+	// fmu serializes writes to the snapshot file.
+	fmu sync.Mutex
+
+	// dirty has something in it when the snapshot needs writing.
+	dirty chan struct{}
+}
+
+// NewFileStore returns a `FileStore` persisting to the file at the given
+// path, loaded with the sessions saved in it if it exists.
+func NewFileStore(path string) (*FileStore, error) {
+	fs := &FileStore{
+		path:  path,
+		dirty: make(chan struct{}, 1),
+	}
+
+	records, err := fs.load()
+	if err != nil {
+		return nil, err
+	}
+
+	fs.MemoryStore = newMemoryStore(fs.markDirty)
+	fs.mu.Lock()
+	for _, r := range records {
+		fs.add(sessionFromRecord(r))
+	}
+	fs.mu.Unlock()
+
+	go fs.writer(SaveDelay)
+	return fs, nil
+}
+
+// markDirty marks the snapshot as needing to be written. It never blocks, so
+// that changes to sessions aren't held up by the disk.
+func (fs *FileStore) markDirty() {
+	select {
+	case fs.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// writer writes the snapshot the given delay after it is marked as needing
+// it, for ever.
+func (fs *FileStore) writer(delay time.Duration) {
+	for range fs.dirty {
+		time.Sleep(delay)
+
+		// Anything that changed while waiting is in this snapshot.
+		select {
+		case <-fs.dirty:
+		default:
+		}
+		fs.save()
+	}
+}
+
+// Flush writes a snapshot of every session straight away, e.g. before the
+// server exits.
+func (fs *FileStore) Flush() {
+	fs.save()
+}
+
+// load reads the session records in the snapshot file. A missing file is
+// not an error, just an empty store.
+func (fs *FileStore) load() ([]SessionRecord, error) {
+	data, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []SessionRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// Records returns a `SessionRecord` for every session in the store.
+func (fs *FileStore) Records() []SessionRecord {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	records := make([]SessionRecord, 0, len(fs.sessions))
+	for _, s := range fs.sessions {
+		s.mu.Lock()
+		records = append(records, s.record())
+		s.mu.Unlock()
+	}
+	return records
+}
+
+// save writes a snapshot of every session to the store's file. The snapshot
+// is written to a temporary file first and then renamed over the old one, so
+// that a crash mid-write never leaves a truncated snapshot behind.
+func (fs *FileStore) save() {
+	fs.fmu.Lock()
+	defer fs.fmu.Unlock()
+
+	data, err := json.Marshal(fs.Records())
+	if err != nil {
+		panic("marshaling session records failed: " + err.Error())
+	}
+
+	tmp := fs.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.WithField("store_path", fs.path).Error(err)
+		return
+	}
+
+	if err := os.Rename(tmp, fs.path); err != nil {
+		log.WithField("store_path", fs.path).Error(err)
+	}
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreSavesAndReloads(t *testing.T) {
+	testSettings(t)
+	delay := SaveDelay
+	SaveDelay = 10 * time.Millisecond
+	defer func() { SaveDelay = delay }()
+
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	fs, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	so := newFakeSocket("a")
+	s, err := fs.Create("1", NetflixMedia(80018499), 0, so, "alice", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := s.SetTime("a", i, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("snapshot was never written")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	fs.Flush()
+
+	again, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := again.Get("1")
+	if !ok {
+		t.Fatal("session was not reloaded")
+	}
+	if r.Media != s.Media {
+		t.Errorf("reloaded media %v, want %v", r.Media, s.Media)
+	}
+}
@@ -0,0 +1,213 @@
+package models
+
+import (
+	"time"
+
+	"github.com/flixy/flixy/Godeps/_workspace/src/github.com/googollee/go-socket.io"
+)
+
+var (
+	// SyncInterval is how often playing sessions send every member a
+	// `flixy sync`, and check whether any of them have drifted. Sessions
+	// have no heartbeat at all if it is 0.
+	SyncInterval = 5 * time.Second
+
+	// DriftNudge is how far a member may drift from the session before
+	// being told to speed up or slow down to catch it up.
+	DriftNudge = 250 * time.Millisecond
+
+	// DriftSeek is how far a member may drift from the session before
+	// being told to seek straight back to it instead.
+	DriftSeek = 2 * time.Second
+
+	// NudgeMaxRate is the most a nudge changes the rate a member plays
+	// at, as a fraction of the session's rate.
+	NudgeMaxRate = 0.05
+)
+
+// CorrectionKind is how a member who has drifted from the session should get
+// back to it.
+type CorrectionKind string
+
+// These are the kinds of correction members can be sent.
+const (
+	// CorrectionNudge means the member should play at `Rate` until their
+	// next `flixy sync`, which will have caught them up.
+	CorrectionNudge CorrectionKind = "nudge"
+	// CorrectionSeek means the member should seek to `Time`.
+	CorrectionSeek CorrectionKind = "seek"
+)
+
+// WireCorrection is the payload of `flixy correction`, which is sent to
+// members who have drifted from the session.
+type WireCorrection struct {
+	Kind CorrectionKind `json:"kind"`
+	// Drift is how far ahead of the session the member was, in
+	// milliseconds; it is negative if they were behind.
+	Drift int `json:"drift"`
+	// Time and ServerTime are as in `WireSession`.
+	Time       int   `json:"time"`
+	ServerTime int64 `json:"server_time"`
+	// Rate is the rate to play at, for a nudge.
+	Rate float64 `json:"rate,omitempty"`
+}
+
+// correction is a `WireCorrection` along with who it is for, so that it can
+// be sent once the session's lock has been released.
+type correction struct {
+	so socketio.Socket
+	wc WireCorrection
+}
+
+// startHeartbeat starts the session's heartbeat, which syncs its members every
+// interval while it is playing, if it isn't running already. It does nothing
+// if interval is 0.
+func (s *Session) startHeartbeat(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.quit != nil {
+		return
+	}
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go s.heartbeat(interval, s.quit, s.done)
+}
+
+// stopHeartbeat stops the session's heartbeat, if it is running, and waits
+// for it to finish. It must be called without holding the session's lock.
+func (s *Session) stopHeartbeat() {
+	s.mu.Lock()
+	quit, done := s.quit, s.done
+	s.quit = nil
+	s.done = nil
+	s.mu.Unlock()
+
+	if quit == nil {
+		return
+	}
+
+	close(quit)
+	<-done
+}
+
+// heartbeat beats every interval until quit is closed, then closes done.
+func (s *Session) heartbeat(interval time.Duration, quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.C:
+			s.beat(interval)
+		}
+	}
+}
+
+// beat pings every member who hasn't been for `PingInterval`, and if the
+// session is playing, syncs every member and sends a correction to each one
+// who has drifted from it.
+func (s *Session) beat(interval time.Duration) {
+	now := time.Now()
+
+	s.mu.Lock()
+	var pings []*Member
+	for _, m := range s.Members {
+		if !m.away && now.Sub(m.latency.pinged) >= PingInterval {
+			pings = append(pings, m)
+		}
+	}
+	paused := s.clock.Paused()
+	s.mu.Unlock()
+
+	for _, m := range pings {
+		m.Ping()
+	}
+	if paused {
+		return
+	}
+
+	s.mu.Lock()
+	if s.clock.Paused() {
+		s.mu.Unlock()
+		return
+	}
+
+	var cs []correction
+	for _, m := range s.Members {
+		if m.away {
+			continue
+		}
+		if wc, ok := s.drift(m, now, interval); ok {
+			cs = append(cs, correction{m.Socket, wc})
+		}
+	}
+	s.mu.Unlock()
+
+	s.Sync()
+	for _, c := range cs {
+		c.so.Emit("flixy correction", c.wc)
+	}
+}
+
+// drift works out how far the given member has drifted from the session, as
+// of the last position they reported, returning the correction to send them
+// if it is too far. Members who haven't reported a position since they were
+// last corrected, since the clock was last re-anchored, or for longer than
+// two intervals, are left alone. The caller must hold the session's lock.
+func (s *Session) drift(m *Member, now time.Time, interval time.Duration) (WireCorrection, bool) {
+	if m.state != StatePlaying || !m.reported.After(m.corrected) || now.Sub(m.reported) > 2*interval {
+		return WireCorrection{}, false
+	}
+	// A position reported before a seek, pause or change of rate is on a
+	// timeline the session has since left.
+	if s.clock.anchoredSince(m.reported) {
+		return WireCorrection{}, false
+	}
+
+	// The member was already half a round trip further along by the time
+	// their report arrived.
+	ahead := float64(m.latency.best().RTT) / 2 * s.clock.rate
+	drift := m.position + int(ahead) - s.clock.at(m.reported)
+
+	abs := time.Duration(drift) * time.Millisecond
+	if abs < 0 {
+		abs = -abs
+	}
+	if abs < DriftNudge {
+		return WireCorrection{}, false
+	}
+
+	m.corrected = now
+	wc := WireCorrection{
+		Kind:       CorrectionSeek,
+		Drift:      drift,
+		Time:       s.clock.at(now),
+		ServerTime: unixMillis(now),
+	}
+	if abs >= DriftSeek {
+		return wc, true
+	}
+
+	// Make up the drift over the next interval, as far as the rate may
+	// be nudged.
+	nudge := -float64(drift) / (float64(interval) / float64(time.Millisecond))
+	if nudge > NudgeMaxRate {
+		nudge = NudgeMaxRate
+	} else if nudge < -NudgeMaxRate {
+		nudge = -NudgeMaxRate
+	}
+	wc.Kind = CorrectionNudge
+	wc.Rate = s.clock.rate * (1 + nudge)
+
+	return wc, true
+}
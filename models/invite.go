@@ -0,0 +1,239 @@
+package models
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidInvite is returned for invite tokens flixy didn't sign,
+	// and for invites asked to expire or be used up in the past, or to
+	// last longer than `InviteMaxTTL`.
+	ErrInvalidInvite = errors.New("invalid invite")
+
+	// ErrInviteExpired is returned for invites which have expired.
+	ErrInviteExpired = errors.New("invite has expired")
+
+	// ErrInviteUsedUp is returned for invites which have already been
+	// used as many times as they may be.
+	ErrInviteUsedUp = errors.New("invite has been used up")
+
+	// ErrInviteRevoked is returned for invites which were signed by flixy
+	// but are no longer outstanding, because the host revoked them.
+	ErrInviteRevoked = errors.New("invite has been revoked")
+
+	// ErrTooManyInvites is returned when creating an invite for a session
+	// which already has `InviteLimit` outstanding.
+	ErrTooManyInvites = errors.New("too many invites")
+)
+
+var (
+	// InviteLimit is how many invites may be outstanding for a session at
+	// once.
+	InviteLimit = 100
+
+	// InviteMaxTTL is the longest an invite which expires may last for.
+	InviteMaxTTL = 365 * 24 * time.Hour
+)
+
+// WireInvite is an invite to a session, as sent to its host in `flixy invite`
+// and `flixy invites`.
+type WireInvite struct {
+	ID string `json:"id"`
+	// Token is what to hand out to whoever is invited, who can join the
+	// session with it or follow `/invite/:token`.
+	Token string `json:"token"`
+	// Expires is when the invite expires, in milliseconds since the Unix
+	// epoch, or 0 if it never does.
+	Expires int64 `json:"expires"`
+	// MaxUses is how many times the invite may be used, or 0 if there's
+	// no limit, and Uses how many times it has been.
+	MaxUses   int    `json:"max_uses"`
+	Uses      int    `json:"uses"`
+	CreatedBy string `json:"created_by"`
+	// Created is when the invite was made, in milliseconds since the Unix
+	// epoch.
+	Created int64 `json:"created"`
+}
+
+// validInviteTTL returns whether an invite may be asked to last for the given
+// number of seconds, or 0 for ever. Checking it before making it a
+// `time.Duration` keeps huge ones from overflowing into short ones.
+func validInviteTTL(ttl int) bool {
+	return ttl >= 0 && int64(ttl) <= int64(InviteMaxTTL/time.Second)
+}
+
+// usable returns why the invite can't be used at the given time, if it
+// can't.
+func (wi WireInvite) usable(now time.Time) error {
+	if wi.Expires != 0 && unixMillis(now) >= wi.Expires {
+		return ErrInviteExpired
+	}
+	if wi.MaxUses != 0 && wi.Uses >= wi.MaxUses {
+		return ErrInviteUsedUp
+	}
+	return nil
+}
+
+// Invite is what an invite token says, once its signature has been checked.
+type Invite struct {
+	SessionID string
+	ID        string
+	// Expires is as in `WireInvite`.
+	Expires int64
+}
+
+// inviteToken returns the signed token of the invite with the given fields,
+// which is of the form "sid.id.expires.signature".
+func inviteToken(sid, id string, expires int64) string {
+	e := strconv.FormatInt(expires, 10)
+	return sid + "." + id + "." + e + "." + sign(sid+"."+id+"."+e)
+}
+
+// ParseInvite checks the signature of the given invite token and returns
+// what it says. It returns `ErrInvalidInvite` if flixy didn't sign it, and
+// `ErrInviteExpired` if it has expired; whether it has been used up or
+// revoked is up to the session it is for.
+func ParseInvite(token string) (Invite, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || !ValidSessionID(parts[0]) {
+		return Invite{}, ErrInvalidInvite
+	}
+
+	if !signed(parts[0]+"."+parts[1]+"."+parts[2], parts[3]) {
+		return Invite{}, ErrInvalidInvite
+	}
+
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return Invite{}, ErrInvalidInvite
+	}
+	if expires != 0 && unixMillis(time.Now()) >= expires {
+		return Invite{}, ErrInviteExpired
+	}
+
+	return Invite{SessionID: parts[0], ID: parts[1], Expires: expires}, nil
+}
+
+// CreateInvite makes a new invite to the session on behalf of its host,
+// which expires after the given time (never if 0) and may be used the given
+// number of times (any number if 0).
+func (s *Session) CreateInvite(by string, ttl time.Duration, maxUses int) (WireInvite, error) {
+	if ttl < 0 || ttl > InviteMaxTTL || maxUses < 0 {
+		return WireInvite{}, ErrInvalidInvite
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return WireInvite{}, err
+	}
+
+	now := time.Now()
+	var expires int64
+	if ttl > 0 {
+		expires = unixMillis(now.Add(ttl))
+	}
+
+	s.mu.Lock()
+	if err := s.hostOnly(by); err != nil {
+		s.mu.Unlock()
+		return WireInvite{}, err
+	}
+
+	// Invites nobody can use any more are only kept around so that
+	// they can be told apart from revoked ones, which isn't worth
+	// turning down new ones for.
+	for iid, wi := range s.invites {
+		if wi.usable(now) != nil {
+			delete(s.invites, iid)
+		}
+	}
+	if len(s.invites) >= InviteLimit {
+		s.mu.Unlock()
+		return WireInvite{}, ErrTooManyInvites
+	}
+
+	wi := WireInvite{
+		ID:        id,
+		Token:     inviteToken(s.SessionID, id, expires),
+		Expires:   expires,
+		MaxUses:   maxUses,
+		CreatedBy: by,
+		Created:   unixMillis(now),
+	}
+	s.invites[id] = wi
+	s.mu.Unlock()
+
+	s.changed()
+	return wi, nil
+}
+
+// RevokeInvite revokes the invite to the session with the given ID on behalf
+// of its host, so that it can't be used any more.
+func (s *Session) RevokeInvite(by string, id string) error {
+	s.mu.Lock()
+	if err := s.hostOnly(by); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if _, ok := s.invites[id]; !ok {
+		s.mu.Unlock()
+		return ErrInviteRevoked
+	}
+	delete(s.invites, id)
+	s.mu.Unlock()
+
+	s.changed()
+	return nil
+}
+
+// Invites returns the session's outstanding invites, oldest first, on behalf
+// of its host.
+func (s *Session) Invites(by string) ([]WireInvite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.hostOnly(by); err != nil {
+		return nil, err
+	}
+
+	wis := make([]WireInvite, 0, len(s.invites))
+	for _, wi := range s.invites {
+		wis = append(wis, wi)
+	}
+	sort.Sort(byCreated(wis))
+	return wis, nil
+}
+
+// CheckInvite returns why the invite to the session with the given ID can't
+// be used, if it can't, without using it.
+func (s *Session) CheckInvite(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wi, ok := s.invites[id]
+	if !ok {
+		return ErrInviteRevoked
+	}
+	return wi.usable(time.Now())
+}
+
+// InviteURL returns the URL at which to watch the session's media, with the
+// given invite token set in it so that the extension can join the session
+// with it once it gets there.
+func (s *Session) InviteURL(token string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Media.watchURL("flixyInvite", token)
+}
+
+// byCreated sorts invites in the order they were made.
+type byCreated []WireInvite
+
+func (a byCreated) Len() int           { return len(a) }
+func (a byCreated) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byCreated) Less(i, j int) bool { return a[i].Created < a[j].Created }
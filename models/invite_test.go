@@ -0,0 +1,121 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSessionID returns a new session ID in the "numeric" format.
+func testSessionID(t *testing.T) string {
+	sid, err := IDFormats["numeric"].Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sid
+}
+
+func TestParseInvite(t *testing.T) {
+	sid := testSessionID(t)
+	token := inviteToken(sid, "abc", 0)
+	inv, err := ParseInvite(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.SessionID != sid || inv.ID != "abc" {
+		t.Errorf("got invite %+v", inv)
+	}
+
+	parts := strings.Split(token, ".")
+	for _, c := range []struct {
+		name, token string
+		want        error
+	}{
+		{"tampered signature", token[:len(token)-1] + "x", ErrInvalidInvite},
+		{"tampered session", testSessionID(t) + "." + strings.Join(parts[1:], "."), ErrInvalidInvite},
+		{"tampered expiry", strings.Join([]string{parts[0], parts[1], "1", parts[3]}, "."), ErrInvalidInvite},
+		{"truncated", strings.Join(parts[:3], "."), ErrInvalidInvite},
+		{"expired", inviteToken(sid, "abc", unixMillis(time.Now())-1), ErrInviteExpired},
+	} {
+		if _, err := ParseInvite(c.token); err != c.want {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestCreateInviteMessageTTL(t *testing.T) {
+	sid := testSessionID(t)
+	for _, c := range []struct {
+		ttl  int
+		want error
+	}{
+		{0, nil},
+		{3600, nil},
+		{-1, ErrInvalidInvite},
+		{int(InviteMaxTTL/time.Second) + 1, ErrInvalidInvite},
+		{1 << 40, ErrInvalidInvite},
+	} {
+		m := CreateInviteMessage{SessionID: sid, TTL: c.ttl}
+		if err := m.Validate(); err != c.want {
+			t.Errorf("ttl %d: got error %v, want %v", c.ttl, err, c.want)
+		}
+	}
+}
+
+func TestAdmitInvite(t *testing.T) {
+	st := newTestStore(t)
+
+	s, err := st.Create("1", NetflixMedia(80018499), 0, newFakeSocket("a"), "alice", SessionOptions{Password: "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := st.Create("2", NetflixMedia(80018499), 0, newFakeSocket("z"), "zed", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	once, err := s.CreateInvite("a", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := s.CreateInvite("a", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeInvite("a", revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+	elsewhere, err := other.CreateInvite("z", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Making an invite forgets those that have already expired, so this
+	// one has to be the last.
+	brief, err := s.CreateInvite("a", time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// An invite lets its holder in without the password.
+	if _, err := st.Join("1", newFakeSocket("b"), "bob", Credentials{Invite: once.ID}); err != nil {
+		t.Fatalf("joining with an invite: %v", err)
+	}
+
+	for _, c := range []struct {
+		name, invite string
+		want         error
+	}{
+		{"used up", once.ID, ErrInviteUsedUp},
+		{"expired", brief.ID, ErrInviteExpired},
+		{"revoked", revoked.ID, ErrInviteRevoked},
+		{"another session's", elsewhere.ID, ErrInviteRevoked},
+	} {
+		if _, err := st.Join("1", newFakeSocket("c"), "carol", Credentials{Invite: c.invite}); err != c.want {
+			t.Errorf("%s invite: got error %v, want %v", c.name, err, c.want)
+		}
+	}
+	if n := s.Len(); n != 2 {
+		t.Errorf("session has %d members, want 2", n)
+	}
+}
@@ -0,0 +1,144 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInvalidPong is returned for `flixy pong` messages that don't answer a
+// `flixy ping` the member was sent and hasn't answered yet.
+var ErrInvalidPong = errors.New("invalid pong")
+
+// latencySamples is how many of a member's most recent pings are kept to
+// estimate their latency from, and how many may be awaiting an answer.
+const latencySamples = 8
+
+// PingInterval is how often the heartbeat of a session sends each of its
+// members a `flixy ping`, so that their latency is kept up to date.
+var PingInterval = 30 * time.Second
+
+// WirePing is the payload of `flixy ping`, which the server sends to members
+// to measure their latency.
+type WirePing struct {
+	// ServerTime is when the server sent the ping, in milliseconds since
+	// the Unix epoch, to be sent back in the `flixy pong`.
+	ServerTime int64 `json:"server_time"`
+}
+
+// WireLatency is the payload of `flixy latency`, which tells a member what
+// the server has worked out about their connection.
+type WireLatency struct {
+	// RTT is the round-trip time between the server and the member, in
+	// milliseconds.
+	RTT int64 `json:"rtt"`
+	// Offset is how far the member's clock is ahead of the server's, in
+	// milliseconds.
+	Offset int64 `json:"offset"`
+}
+
+// latency estimates a member's round-trip time and clock offset, NTP-style,
+// from their last few pings. The sample with the shortest round trip is the
+// one least thrown off by queueing along the way, so it is the one used.
+type latency struct {
+	samples [latencySamples]WireLatency
+	n       int
+
+	// pending are the times the pings which haven't been answered yet
+	// were sent at, oldest first, and pinged when the last one was.
+	pending []int64
+	pinged  time.Time
+}
+
+// sent records a ping sent at the given time, forgetting the oldest
+// unanswered ping if there are too many.
+func (l *latency) sent(t time.Time) {
+	if len(l.pending) == latencySamples {
+		l.pending = l.pending[1:]
+	}
+	l.pending = append(l.pending, unixMillis(t))
+	l.pinged = t
+}
+
+// answered forgets the unanswered ping sent at t0, returning whether there
+// was one.
+func (l *latency) answered(t0 int64) bool {
+	for i, t := range l.pending {
+		if t == t0 {
+			l.pending = append(l.pending[:i], l.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// add records a ping sent at t0 by the server's clock, received by the
+// member at t1 by theirs, and answered by the time t2 it arrived back.
+func (l *latency) add(t0, t1, t2 int64) {
+	rtt := t2 - t0
+	l.samples[l.n%latencySamples] = WireLatency{
+		RTT:    rtt,
+		Offset: t1 - (t0 + rtt/2),
+	}
+	l.n++
+}
+
+// best returns the estimate from the sample with the shortest round trip,
+// which is the zero value if there are none yet.
+func (l *latency) best() WireLatency {
+	n := l.n
+	if n > latencySamples {
+		n = latencySamples
+	}
+
+	var best WireLatency
+	for i := 0; i < n; i++ {
+		if i == 0 || l.samples[i].RTT < best.RTT {
+			best = l.samples[i]
+		}
+	}
+	return best
+}
+
+// unixMillis returns the given time in milliseconds since the Unix epoch.
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Ping sends the member a `flixy ping`, which they answer with a `flixy pong`
+// to be passed to `Session.Pong`.
+func (m *Member) Ping() {
+	now := time.Now()
+
+	m.Session.mu.Lock()
+	m.latency.sent(now)
+	so := m.Socket
+	m.Session.mu.Unlock()
+
+	so.Emit("flixy ping", WirePing{ServerTime: unixMillis(now)})
+}
+
+// Pong records the answer of the member with the given ID to a `flixy ping`
+// sent at serverTime, which they received at clientTime by their own clock,
+// and tells them their latency as it now stands. serverTime must be that of
+// a ping the member was sent and hasn't answered yet.
+func (s *Session) Pong(id string, serverTime int64, clientTime int64) (WireLatency, error) {
+	now := unixMillis(time.Now())
+
+	s.mu.Lock()
+	m, ok := s.Members[id]
+	if !ok {
+		s.mu.Unlock()
+		return WireLatency{}, ErrNotMember
+	}
+	if !m.latency.answered(serverTime) {
+		s.mu.Unlock()
+		return WireLatency{}, ErrInvalidPong
+	}
+	m.latency.add(serverTime, clientTime, now)
+	wl := m.latency.best()
+	so := m.Socket
+	s.mu.Unlock()
+
+	so.Emit("flixy latency", wl)
+	return wl, nil
+}
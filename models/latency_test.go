@@ -0,0 +1,85 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPongMustAnswerPing(t *testing.T) {
+	st := newTestStore(t)
+	so := newFakeSocket("a")
+	s, err := st.Create("1", NetflixMedia(80018499), 0, so, "alice", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	pending := append([]int64{}, s.Members["a"].latency.pending...)
+	s.mu.Unlock()
+	if len(pending) != 1 {
+		t.Fatalf("%d pings pending after joining, want 1", len(pending))
+	}
+
+	if _, err := s.Pong("a", pending[0]-1, 0); err != ErrInvalidPong {
+		t.Errorf("pong to a ping never sent: got error %v, want %v", err, ErrInvalidPong)
+	}
+	if _, err := s.Pong("a", pending[0], pending[0]); err != nil {
+		t.Errorf("pong to a ping sent: %v", err)
+	}
+	if _, err := s.Pong("a", pending[0], pending[0]); err != ErrInvalidPong {
+		t.Errorf("second pong to a ping: got error %v, want %v", err, ErrInvalidPong)
+	}
+}
+
+func TestHeartbeatPings(t *testing.T) {
+	interval := PingInterval
+	PingInterval = 0
+	defer func() { PingInterval = interval }()
+
+	st := newTestStore(t)
+	so := newFakeSocket("a")
+	s, err := st.Create("1", NetflixMedia(80018499), 0, so, "alice", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Paused sessions aren't synced, but their members are still pinged.
+	s.Pause("a", nil)
+	s.beat(time.Second)
+	s.beat(time.Second)
+	if n := so.sent("flixy ping"); n != 3 {
+		t.Errorf("sent %d pings, want 3", n)
+	}
+}
+
+func TestNoDriftAcrossReanchor(t *testing.T) {
+	st := newTestStore(t)
+	s, err := st.Create("1", NetflixMedia(80018499), 0, newFakeSocket("a"), "alice", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Play("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMemberState("a", StatePlaying, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := s.SetTime("a", 60000, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if wc, ok := s.drift(s.Members["a"], time.Now(), time.Second); ok {
+		t.Errorf("corrected a position reported before a seek: %+v", wc)
+	}
+
+	// Once they report from the new timeline, they are corrected again.
+	m := s.Members["a"]
+	m.position = 0
+	m.reported = time.Now()
+	if _, ok := s.drift(m, time.Now(), time.Second); !ok {
+		t.Error("didn't correct a position reported after the seek")
+	}
+}
@@ -0,0 +1,208 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+// ErrInvalidMedia is returned for media from a provider flixy doesn't know
+// about, or with an ID that provider couldn't have given out.
+var ErrInvalidMedia = errors.New("invalid media")
+
+// Media identifies a video on some provider, e.g. Netflix or YouTube.
+type Media struct {
+	// Provider is the name of the video's provider in `Providers`.
+	Provider string `json:"provider"`
+	// ID is what the provider calls the video, whose shape depends on
+	// the provider.
+	ID string `json:"id"`
+}
+
+// Provider knows about the videos of a particular streaming site.
+type Provider interface {
+	// Valid returns whether the given ID could be one of the provider's
+	// videos.
+	Valid(id string) bool
+
+	// WatchURL returns the URL at which to watch the video with the
+	// given ID, with the given parameters set in it so that the
+	// extension can join the session once it gets there.
+	WatchURL(id string, params url.Values) string
+
+	// Redirect returns whether the server may redirect people to the
+	// provider's watch URLs. Providers whose watch URLs could be anywhere
+	// mustn't, or the server would be an open redirect.
+	Redirect() bool
+}
+
+// Providers are the providers flixy knows about, by name.
+var Providers = map[string]Provider{
+	"netflix": netflixProvider{},
+	"youtube": youtubeProvider{},
+	"url":     urlProvider{},
+}
+
+// NetflixMedia returns the `Media` for the Netflix video with the given ID,
+// which is what video IDs always meant before flixy knew about any other
+// provider.
+func NetflixMedia(vid int) Media {
+	return Media{Provider: "netflix", ID: strconv.Itoa(vid)}
+}
+
+// Validate returns `ErrInvalidMedia` if the media's provider is not in
+// `Providers`, or its ID is not one that provider could have given out.
+func (m Media) Validate() error {
+	p, ok := Providers[m.Provider]
+	if !ok || !p.Valid(m.ID) {
+		return ErrInvalidMedia
+	}
+	return nil
+}
+
+// WatchURL returns the URL at which to watch the media as part of the session
+// with the given ID, or an empty string if its provider isn't known.
+func (m Media) WatchURL(sid string) string {
+	return m.watchURL("flixySessionId", sid)
+}
+
+// watchURL returns the URL at which to watch the media with the given
+// parameter set in it, or an empty string if its provider isn't known.
+func (m Media) watchURL(key, value string) string {
+	p, ok := Providers[m.Provider]
+	if !ok {
+		return ""
+	}
+	return p.WatchURL(m.ID, url.Values{key: {value}})
+}
+
+// Redirect returns whether the server may redirect people to the media's
+// watch URL, which it may not if its provider isn't known.
+func (m Media) Redirect() bool {
+	p, ok := Providers[m.Provider]
+	return ok && p.Redirect()
+}
+
+// VideoID returns the Netflix video ID of the media, or 0 if it isn't a
+// Netflix video, for clients which only know about `video_id`.
+func (m Media) VideoID() int {
+	if m.Provider != "netflix" {
+		return 0
+	}
+	vid, _ := strconv.Atoi(m.ID)
+	return vid
+}
+
+// String returns the media in the form "provider:id".
+func (m Media) String() string {
+	return m.Provider + ":" + m.ID
+}
+
+// resolveMedia returns the media a message refers to, given its `video_id`
+// and `media` fields; `media` wins if both are given.
+func resolveMedia(vid int, m *Media) (Media, error) {
+	if m != nil {
+		if err := m.Validate(); err != nil {
+			return Media{}, err
+		}
+		return *m, nil
+	}
+
+	if vid <= 0 {
+		return Media{}, ErrInvalidVideoID
+	}
+	return NetflixMedia(vid), nil
+}
+
+// netflixProvider is the `Provider` for Netflix, whose video IDs are
+// numbers.
+type netflixProvider struct{}
+
+var netflixIDPattern = regexp.MustCompile(`^[0-9]{1,18}$`)
+
+// Valid implements `Provider`.
+func (netflixProvider) Valid(id string) bool {
+	return netflixIDPattern.MatchString(id)
+}
+
+// WatchURL implements `Provider`.
+func (netflixProvider) WatchURL(id string, params url.Values) string {
+	// is this totally overengineered? should I just string cat these
+	// together?
+	var u *url.URL
+	u, err := url.Parse("https://www.netflix.com")
+	if err != nil {
+		// something has gone *seriously* wrong
+		panic("URL parsing a simple URL failed")
+	}
+
+	u.Path += fmt.Sprintf("/watch/%s", id)
+	u.RawQuery = params.Encode()
+
+	return u.String()
+}
+
+// Redirect implements `Provider`.
+func (netflixProvider) Redirect() bool {
+	return true
+}
+
+// youtubeProvider is the `Provider` for YouTube, whose video IDs are 11
+// characters of URL-safe base64.
+type youtubeProvider struct{}
+
+var youtubeIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+// Valid implements `Provider`.
+func (youtubeProvider) Valid(id string) bool {
+	return youtubeIDPattern.MatchString(id)
+}
+
+// WatchURL implements `Provider`.
+func (youtubeProvider) WatchURL(id string, params url.Values) string {
+	// Built by hand, as `url.Values` would sort the video ID after
+	// flixy's parameters.
+	return "https://www.youtube.com/watch?v=" + url.QueryEscape(id) + "&" + params.Encode()
+}
+
+// Redirect implements `Provider`.
+func (youtubeProvider) Redirect() bool {
+	return true
+}
+
+// urlProvider is the `Provider` for videos anywhere else, e.g. self-hosted
+// ones, whose IDs are the http or https URLs of the pages to watch them on.
+type urlProvider struct{}
+
+// Valid implements `Provider`.
+func (urlProvider) Valid(id string) bool {
+	u, err := url.Parse(id)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// WatchURL implements `Provider`.
+func (urlProvider) WatchURL(id string, params url.Values) string {
+	u, err := url.Parse(id)
+	if err != nil {
+		return id
+	}
+
+	q := u.Query()
+	for k, vs := range params {
+		q[k] = vs
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// Redirect implements `Provider`. Anybody can start a session on any URL,
+// so the server only links to them.
+func (urlProvider) Redirect() bool {
+	return false
+}
@@ -0,0 +1,19 @@
+package models
+
+import "testing"
+
+func TestMediaRedirect(t *testing.T) {
+	for _, c := range []struct {
+		m    Media
+		want bool
+	}{
+		{NetflixMedia(80018499), true},
+		{Media{Provider: "youtube", ID: "dQw4w9WgXcQ"}, true},
+		{Media{Provider: "url", ID: "https://evil.example/watch"}, false},
+		{Media{Provider: "nope", ID: "1"}, false},
+	} {
+		if got := c.m.Redirect(); got != c.want {
+			t.Errorf("%v: Redirect() = %v, want %v", c.m, got, c.want)
+		}
+	}
+}
@@ -1,32 +1,122 @@
 package models
 
-import "github.com/flixy/flixy/Godeps/_workspace/src/github.com/googollee/go-socket.io"
+import (
+	"time"
 
-// Member is the *internal* representation of a member of a flixy session. It
-// currently has only a socket, but will have a `nickname` or something like it
-// in the near future.
+	"github.com/flixy/flixy/Godeps/_workspace/src/github.com/googollee/go-socket.io"
+)
+
+// Member is the *internal* representation of a member of a flixy session.
 type Member struct {
+	// Socket is the member's socket, which changes if they resume with
+	// another one, so it must only be touched holding the session's lock.
 	Socket socketio.Socket
 	*Session
+	// Nick is the member's nick, which is unique within their session
+	// (see `NormalizeNick` and `Session.SetNick`).
 	Nick string `json:"nick"`
+
+	// ID identifies the member within their session. It is the ID of the
+	// socket they joined with, and stays the same when they resume with
+	// another.
+	ID string
+
+	// token is what the member has to show to resume, and away whether
+	// they have disconnected and not yet resumed. awayGen counts how many
+	// times they have gone away or come back.
+	token   string
+	away    bool
+	awayGen int
+
+	// ip is the remote address the member is connected from, for banning
+	// them by.
+	ip string
+
+	// joined is when the member joined, so that the longest-standing
+	// member can take over as host.
+	joined time.Time
+
+	// state and position are what the member's player is doing and
+	// where it is, as last reported by the member.
+	state    MemberState
+	position int
+
+	// reported is when the member last reported their state, and
+	// corrected when they were last sent a `flixy correction`.
+	reported  time.Time
+	corrected time.Time
+
+	// latency estimates the member's round-trip time and clock offset
+	// from their answers to `flixy ping`.
+	latency latency
+
+	// chat, annotate and rename limit how fast the member may send chat
+	// messages and annotations, and change their nick.
+	chat     chatLimiter
+	annotate chatLimiter
+	rename   chatLimiter
 }
 
 // WireMember is the *external* representation of a member of a flixy session.
-// It has nothing in it currently, but will have a `nickname` or something like
-// it in the neat future.
 type WireMember struct {
+	// ID is the member's ID, which stays the same for as long as they
+	// are in the session, whatever their nick.
+	ID   string `json:"id"`
 	Nick string `json:"nick"`
+
+	// State and Position are what the member's player is doing and where
+	// it is, in milliseconds, as last reported by the member. State is
+	// empty until the member reports one.
+	State    MemberState `json:"state"`
+	Position int         `json:"position"`
+
+	// RTT is the round-trip time between the member and the server they
+	// are connected to, in milliseconds, or 0 if it hasn't been measured
+	// yet.
+	RTT int64 `json:"rtt"`
+
+	// Away is whether the member has disconnected, and may yet resume.
+	Away bool `json:"away"`
+
+	// Control is whether the member may play, pause and seek the
+	// session. It is filled in by `Session.GetWireSession`.
+	Control bool `json:"control"`
 }
 
 // Sync tells the given member the state of the session.
 func (m *Member) Sync() {
-	m.Socket.Emit("flixy sync", m.Session.GetWireSession())
+	m.socket().Emit("flixy sync", m.Session.GetWireSession())
+}
+
+// welcome syncs a newly added member to the session, tells them which
+// session they have joined and how to resume it, replays its chat history to
+// them and starts measuring their latency.
+func (m *Member) welcome() {
+	m.Sync()
+
+	// Touching the member's socket directly feels wrong. This should
+	// probably become non-exported.
+	so := m.socket()
+	so.Emit("flixy join session", m.Session.GetWireSession())
+	so.Emit("flixy resume token", WireResumeToken{
+		SessionID: m.Session.SessionID,
+		MemberID:  m.ID,
+		Token:     m.token,
+	})
+	so.Emit("flixy chat history", m.Session.ChatHistory())
+	m.Ping()
 }
 
 // ToWireMember converts a given `Member` to a `WireMember`, which
 // sanitizes the arguments to be suitable to be sent over a socket.io
 // connection.
 func (m *Member) ToWireMember() WireMember {
-	// TODO include ID, nick, etc
-	return WireMember{m.Nick}
+	return WireMember{
+		ID:       m.ID,
+		Nick:     m.Nick,
+		State:    m.state,
+		Position: m.position,
+		RTT:      m.latency.best().RTT,
+		Away:     m.away,
+	}
 }
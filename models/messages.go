@@ -3,30 +3,117 @@ package models
 // these are the internal message structs that JSON gets unmarshaled into.
 // please do not depend on them, aside from client authors structuring their
 // JSON data around it
+//
+// every message may also carry a `request_id`, which the server echoes back in
+// the acknowledgement and in any `flixy error` it sends in response, so that
+// clients can tell which of their commands was rejected.
+//
+// every message which needs checking beyond being well-formed JSON has a
+// `Validate` method, which handlers must call before acting on it.
+
+// RequestMessage holds the fields common to every message clients send.
+type RequestMessage struct {
+	RequestID string `json:"request_id"`
+}
+
+// validateSessionID returns `ErrInvalidSessionID` if the given session ID is
+// not of any shape flixy generates.
+func validateSessionID(id string) error {
+	if !ValidSessionID(id) {
+		return ErrInvalidSessionID
+	}
+	return nil
+}
 
 // GetSyncMessage is the struct to which `flixy get sync` messages are
 // unmarshaled into.
 type GetSyncMessage struct {
 	SessionID string `json:"session_id"`
+	// Password and Token are only needed to get the state of a session
+	// with a password which the client isn't a member of.
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+// Validate checks the fields of a `GetSyncMessage`.
+func (m GetSyncMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// Credentials returns the credentials a `GetSyncMessage` was sent with.
+func (m GetSyncMessage) Credentials() Credentials {
+	return Credentials{Password: m.Password, Token: m.Token}
 }
 
 // NewMessage is the struct to which `flixy new` messages are unmarshaled into.
 type NewMessage struct {
+	Time   int           `json:"time"`
+	Nick   string        `json:"nick"`
+	Policy ControlPolicy `json:"policy"`
+	// Media is the video to watch. Older clients send a Netflix
+	// `video_id` instead, which is used if Media is left out.
+	Media   *Media `json:"media"`
 	VideoID int    `json:"video_id"`
-	Time    int    `json:"time"`
-	Nick    string `json:"nick"`
+	// AutoPause is whether the session pauses while any of its members
+	// is buffering, or `DefaultAutoPause` if left out.
+	AutoPause *bool `json:"auto_pause"`
+	// Password, if set, is needed to join or see the session.
+	Password string `json:"password"`
+}
+
+// Validate checks the fields of a `NewMessage`.
+func (m NewMessage) Validate() error {
+	if _, err := m.Video(); err != nil {
+		return err
+	}
+	if m.Policy != "" && !m.Policy.Valid() {
+		return ErrInvalidPolicy
+	}
+	return validateNick(m.Nick)
+}
+
+// Options returns the settings a `NewMessage` asks for the session to have.
+func (m NewMessage) Options() SessionOptions {
+	return SessionOptions{
+		Policy:    m.Policy,
+		AutoPause: m.AutoPause,
+		Password:  m.Password,
+	}
+}
+
+// Video returns the media a `NewMessage` asks to watch.
+func (m NewMessage) Video() (Media, error) {
+	return resolveMedia(m.VideoID, m.Media)
 }
 
 // PauseMessage is the struct to which `flixy pause` messages are unmarshaled
 // into.
 type PauseMessage struct {
 	SessionID string `json:"session_id"`
+	// Version is the version of the session's state the client last saw,
+	// if it wants the command rejected should somebody else have changed
+	// it since.
+	Version *int64 `json:"version"`
+}
+
+// Validate checks the fields of a `PauseMessage`.
+func (m PauseMessage) Validate() error {
+	return validateSessionID(m.SessionID)
 }
 
 // PlayMessage is the struct to which `flixy play` messages are unmarshaled
 // into.
 type PlayMessage struct {
 	SessionID string `json:"session_id"`
+	// Version is the version of the session's state the client last saw,
+	// if it wants the command rejected should somebody else have changed
+	// it since.
+	Version *int64 `json:"version"`
+}
+
+// Validate checks the fields of a `PlayMessage`.
+func (m PlayMessage) Validate() error {
+	return validateSessionID(m.SessionID)
 }
 
 // JoinMessage is the struct to which `flixy join` messages are unmarshaled
@@ -34,6 +121,24 @@ type PlayMessage struct {
 type JoinMessage struct {
 	SessionID string `json:"session_id"`
 	Nick      string `json:"nick"`
+	// Invite is an invite token, which may be sent instead of SessionID.
+	Invite string `json:"invite"`
+	// Password and Token are only needed to join a session with a
+	// password without an invite.
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+// Validate checks the fields of a `JoinMessage`.
+func (m JoinMessage) Validate() error {
+	if err := validateNick(m.Nick); err != nil {
+		return err
+	}
+	if m.Invite != "" {
+		_, err := ParseInvite(m.Invite)
+		return err
+	}
+	return validateSessionID(m.SessionID)
 }
 
 // SeekMessage is the struct to which `flixy seek` messages are unmarshaled
@@ -41,4 +146,360 @@ type JoinMessage struct {
 type SeekMessage struct {
 	SessionID string `json:"session_id"`
 	Time      int    `json:"time"`
+	// Version is the version of the session's state the client last saw,
+	// if it wants the command rejected should somebody else have changed
+	// it since.
+	Version *int64 `json:"version"`
+}
+
+// Validate checks the fields of a `SeekMessage`.
+func (m SeekMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// SetHostMessage is the struct to which `flixy set host` messages are
+// unmarshaled into.
+type SetHostMessage struct {
+	SessionID string `json:"session_id"`
+	MemberID  string `json:"member_id"`
+}
+
+// Validate checks the fields of a `SetHostMessage`.
+func (m SetHostMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// SetPolicyMessage is the struct to which `flixy set policy` messages are
+// unmarshaled into.
+type SetPolicyMessage struct {
+	SessionID string        `json:"session_id"`
+	Policy    ControlPolicy `json:"policy"`
+}
+
+// Validate checks the fields of a `SetPolicyMessage`.
+func (m SetPolicyMessage) Validate() error {
+	if !m.Policy.Valid() {
+		return ErrInvalidPolicy
+	}
+	return validateSessionID(m.SessionID)
+}
+
+// GrantMessage is the struct to which `flixy grant` messages are unmarshaled
+// into.
+type GrantMessage struct {
+	SessionID string `json:"session_id"`
+	MemberID  string `json:"member_id"`
+	Control   bool   `json:"control"`
+}
+
+// Validate checks the fields of a `GrantMessage`.
+func (m GrantMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// ChatMessage is the struct to which `flixy chat` messages are unmarshaled
+// into.
+type ChatMessage struct {
+	SessionID string `json:"session_id"`
+	Text      string `json:"text"`
+}
+
+// Validate checks the fields of a `ChatMessage`.
+func (m ChatMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// AnnotateMessage is the struct to which `flixy annotate` messages are
+// unmarshaled into.
+type AnnotateMessage struct {
+	SessionID string         `json:"session_id"`
+	Kind      AnnotationKind `json:"kind"`
+	Text      string         `json:"text"`
+}
+
+// Validate checks the fields of an `AnnotateMessage`.
+func (m AnnotateMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// GetAnnotationsMessage is the struct to which `flixy get annotations`
+// messages are unmarshaled into. `To` may be left out to get every
+// annotation from `From` onwards.
+type GetAnnotationsMessage struct {
+	SessionID string `json:"session_id"`
+	From      int    `json:"from"`
+	To        *int   `json:"to"`
+}
+
+// Validate checks the fields of a `GetAnnotationsMessage`.
+func (m GetAnnotationsMessage) Validate() error {
+	if m.To != nil && *m.To < m.From {
+		return ErrInvalidRange
+	}
+	return validateSessionID(m.SessionID)
+}
+
+// MemberStateMessage is the struct to which `flixy member state` messages are
+// unmarshaled into.
+type MemberStateMessage struct {
+	SessionID string      `json:"session_id"`
+	State     MemberState `json:"state"`
+	Position  int         `json:"position"`
+}
+
+// Validate checks the fields of a `MemberStateMessage`.
+func (m MemberStateMessage) Validate() error {
+	if !m.State.Valid() {
+		return ErrInvalidMemberState
+	}
+	return validateSessionID(m.SessionID)
+}
+
+// SetAutoPauseMessage is the struct to which `flixy set auto pause` messages
+// are unmarshaled into.
+type SetAutoPauseMessage struct {
+	SessionID string `json:"session_id"`
+	AutoPause bool   `json:"auto_pause"`
+}
+
+// Validate checks the fields of a `SetAutoPauseMessage`.
+func (m SetAutoPauseMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// RateMessage is the struct to which `flixy rate` messages are unmarshaled
+// into.
+type RateMessage struct {
+	SessionID string  `json:"session_id"`
+	Rate      float64 `json:"rate"`
+	// Version is the version of the session's state the client last saw,
+	// if it wants the command rejected should somebody else have changed
+	// it since.
+	Version *int64 `json:"version"`
+}
+
+// Validate checks the fields of a `RateMessage`.
+func (m RateMessage) Validate() error {
+	if m.Rate <= 0 {
+		return ErrInvalidRate
+	}
+	return validateSessionID(m.SessionID)
+}
+
+// PongMessage is the struct to which `flixy pong` messages are unmarshaled
+// into.
+type PongMessage struct {
+	SessionID string `json:"session_id"`
+	// ServerTime is the `server_time` of the `flixy ping` being answered.
+	ServerTime int64 `json:"server_time"`
+	// ClientTime is when the client received the ping, by its own clock,
+	// in milliseconds since the Unix epoch.
+	ClientTime int64 `json:"client_time"`
+}
+
+// Validate checks the fields of a `PongMessage`.
+func (m PongMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// EnqueueMessage is the struct to which `flixy enqueue` messages are
+// unmarshaled into.
+type EnqueueMessage struct {
+	SessionID string `json:"session_id"`
+	// Media is the video to watch. Older clients send a Netflix
+	// `video_id` instead, which is used if Media is left out.
+	Media   *Media `json:"media"`
+	VideoID int    `json:"video_id"`
+	// Duration is how long the video is, in milliseconds, if the client
+	// knows, so that the session can move on to the next video by itself
+	// once it has ended.
+	Duration int `json:"duration"`
+}
+
+// Validate checks the fields of an `EnqueueMessage`.
+func (m EnqueueMessage) Validate() error {
+	if _, err := m.Video(); err != nil {
+		return err
+	}
+	return validateSessionID(m.SessionID)
+}
+
+// Video returns the media an `EnqueueMessage` asks to queue up.
+func (m EnqueueMessage) Video() (Media, error) {
+	return resolveMedia(m.VideoID, m.Media)
+}
+
+// ReorderMessage is the struct to which `flixy reorder` messages are
+// unmarshaled into.
+type ReorderMessage struct {
+	SessionID string `json:"session_id"`
+	ItemID    string `json:"item_id"`
+	Index     int    `json:"index"`
+	// Version is the version of the session's state the client last saw,
+	// if it wants the command rejected should somebody else have changed
+	// it since.
+	Version *int64 `json:"version"`
+}
+
+// Validate checks the fields of a `ReorderMessage`.
+func (m ReorderMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// DequeueMessage is the struct to which `flixy dequeue` messages are
+// unmarshaled into.
+type DequeueMessage struct {
+	SessionID string `json:"session_id"`
+	ItemID    string `json:"item_id"`
+	// Version is the version of the session's state the client last saw,
+	// if it wants the command rejected should somebody else have changed
+	// it since.
+	Version *int64 `json:"version"`
+}
+
+// Validate checks the fields of a `DequeueMessage`.
+func (m DequeueMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// AdvanceMessage is the struct to which `flixy advance` messages are
+// unmarshaled into.
+type AdvanceMessage struct {
+	SessionID string `json:"session_id"`
+	// Version is the version of the session's state the client last saw,
+	// if it wants the command rejected should somebody else have changed
+	// it since.
+	Version *int64 `json:"version"`
+}
+
+// Validate checks the fields of an `AdvanceMessage`.
+func (m AdvanceMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// ChangeVideoMessage is the struct to which `flixy change video` messages are
+// unmarshaled into.
+type ChangeVideoMessage struct {
+	SessionID string `json:"session_id"`
+	Time      int    `json:"time"`
+	// Media is the video to watch. Older clients send a Netflix
+	// `video_id` instead, which is used if Media is left out.
+	Media   *Media `json:"media"`
+	VideoID int    `json:"video_id"`
+	// Duration is as in `EnqueueMessage`.
+	Duration int `json:"duration"`
+	// Version is the version of the session's state the client last saw,
+	// if it wants the command rejected should somebody else have changed
+	// it since.
+	Version *int64 `json:"version"`
+}
+
+// Validate checks the fields of a `ChangeVideoMessage`.
+func (m ChangeVideoMessage) Validate() error {
+	if _, err := m.Video(); err != nil {
+		return err
+	}
+	return validateSessionID(m.SessionID)
+}
+
+// Video returns the media a `ChangeVideoMessage` asks to change to.
+func (m ChangeVideoMessage) Video() (Media, error) {
+	return resolveMedia(m.VideoID, m.Media)
+}
+
+// CreateInviteMessage is the struct to which `flixy create invite` messages
+// are unmarshaled into.
+type CreateInviteMessage struct {
+	SessionID string `json:"session_id"`
+	// TTL is how many seconds the invite lasts for, or 0 for ever.
+	TTL int `json:"ttl"`
+	// MaxUses is how many times the invite may be used, or 0 for any
+	// number of times.
+	MaxUses int `json:"max_uses"`
+}
+
+// Validate checks the fields of a `CreateInviteMessage`.
+func (m CreateInviteMessage) Validate() error {
+	if !validInviteTTL(m.TTL) || m.MaxUses < 0 {
+		return ErrInvalidInvite
+	}
+	return validateSessionID(m.SessionID)
+}
+
+// RevokeInviteMessage is the struct to which `flixy revoke invite` messages
+// are unmarshaled into.
+type RevokeInviteMessage struct {
+	SessionID string `json:"session_id"`
+	InviteID  string `json:"invite_id"`
+}
+
+// Validate checks the fields of a `RevokeInviteMessage`.
+func (m RevokeInviteMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// GetInvitesMessage is the struct to which `flixy get invites` messages are
+// unmarshaled into.
+type GetInvitesMessage struct {
+	SessionID string `json:"session_id"`
+}
+
+// Validate checks the fields of a `GetInvitesMessage`.
+func (m GetInvitesMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// ResumeMessage is the struct to which `flixy resume` messages are unmarshaled
+// into.
+type ResumeMessage struct {
+	SessionID string `json:"session_id"`
+	MemberID  string `json:"member_id"`
+	Token     string `json:"token"`
+}
+
+// Validate checks the fields of a `ResumeMessage`.
+func (m ResumeMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// KickMessage is the struct to which `flixy kick` messages are unmarshaled
+// into.
+type KickMessage struct {
+	SessionID string `json:"session_id"`
+	MemberID  string `json:"member_id"`
+}
+
+// Validate checks the fields of a `KickMessage`.
+func (m KickMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// BanMessage is the struct to which `flixy ban` messages are unmarshaled
+// into.
+type BanMessage struct {
+	SessionID string `json:"session_id"`
+	MemberID  string `json:"member_id"`
+}
+
+// Validate checks the fields of a `BanMessage`.
+func (m BanMessage) Validate() error {
+	return validateSessionID(m.SessionID)
+}
+
+// NickMessage is the struct to which `flixy nick` messages are unmarshaled
+// into.
+type NickMessage struct {
+	SessionID string `json:"session_id"`
+	Nick      string `json:"nick"`
+}
+
+// Validate checks the fields of a `NickMessage`.
+func (m NickMessage) Validate() error {
+	if NormalizeNick(m.Nick) == "" {
+		return ErrInvalidNick
+	}
+	if err := validateNick(m.Nick); err != nil {
+		return err
+	}
+	return validateSessionID(m.SessionID)
 }
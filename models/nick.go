@@ -0,0 +1,163 @@
+package models
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/flixy/flixy/Godeps/_workspace/src/golang.org/x/text/unicode/norm"
+)
+
+var (
+	// ErrInvalidNick is returned for nicks with nothing left in them once
+	// they have been normalized.
+	ErrInvalidNick = errors.New("invalid nick")
+
+	// ErrNickTooLong is returned for nicks longer than `NickMaxLength`.
+	ErrNickTooLong = errors.New("nick is too long")
+)
+
+var (
+	// NickMaxLength is the most characters a nick may have.
+	NickMaxLength = 32
+
+	// DefaultNick is the nick of members who join without one.
+	DefaultNick = "(no nick)"
+)
+
+// WireNick is the payload of `flixy nick`, which is sent to everyone in a
+// session when one of its members changes their nick.
+type WireNick struct {
+	SessionID string `json:"session_id"`
+	MemberID  string `json:"member_id"`
+	Old       string `json:"old"`
+	Nick      string `json:"nick"`
+}
+
+// NormalizeNick cleans up the given nick: invalid UTF-8, control characters
+// and invisible formatting characters (e.g. zero-width spaces and direction
+// overrides) are dropped, what is left is put into Unicode normalization form
+// NFKC, every run of whitespace becomes a single space, and leading and
+// trailing whitespace is trimmed. It may return an empty string.
+//
+// NFKC makes nicks which only differ by how their accents are composed, or
+// by compatibility characters such as fullwidth letters, the same, so that
+// nobody can pass for somebody else with a nick which looks just like theirs.
+func NormalizeNick(nick string) string {
+	nick = strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError:
+			return -1
+		case unicode.IsSpace(r):
+			return ' '
+		case unicode.In(r, unicode.Cc, unicode.Cf, unicode.Co, unicode.Cs):
+			return -1
+		}
+		return r
+	}, nick)
+
+	return strings.Join(strings.Fields(norm.NFKC.String(nick)), " ")
+}
+
+// validateNick returns `ErrNickTooLong` if the given nick is longer than
+// `NickMaxLength` once normalized.
+func validateNick(nick string) error {
+	if utf8.RuneCountInString(NormalizeNick(nick)) > NickMaxLength {
+		return ErrNickTooLong
+	}
+	return nil
+}
+
+// truncateNick returns the first n characters of the given nick.
+func truncateNick(nick string, n int) string {
+	r := []rune(nick)
+	if len(r) <= n {
+		return nick
+	}
+	return strings.TrimSpace(string(r[:n]))
+}
+
+// uniqueNick returns the given nick if no other member of the session, on
+// this server or another, has it, ignoring case. Otherwise, it returns the
+// nick with the lowest number after it that nobody has, e.g. "bob 2". The
+// caller must hold the session's lock.
+func (s *Session) uniqueNick(nick string, id string) string {
+	taken := make(map[string]bool, len(s.Members)+len(s.remote))
+	for k, m := range s.Members {
+		if k != id {
+			taken[strings.ToLower(m.Nick)] = true
+		}
+	}
+	for k, wm := range s.remote {
+		if k != id {
+			taken[strings.ToLower(wm.Nick)] = true
+		}
+	}
+
+	if !taken[strings.ToLower(nick)] {
+		return nick
+	}
+	for n := 2; ; n++ {
+		suffix := " " + strconv.Itoa(n)
+		next := truncateNick(nick, NickMaxLength-len(suffix)) + suffix
+		if !taken[strings.ToLower(next)] {
+			return next
+		}
+	}
+}
+
+// joinNick returns the nick a member joining the session with the given ID
+// and nick gets: the nick normalized, or `DefaultNick` if there is nothing
+// left of it, and made unique. The caller must hold the session's lock.
+func (s *Session) joinNick(nick string, id string) string {
+	nick = truncateNick(NormalizeNick(nick), NickMaxLength)
+	if nick == "" {
+		nick = DefaultNick
+	}
+	return s.uniqueNick(nick, id)
+}
+
+// SetNick changes the nick of the member with the given ID to the given one,
+// made unique within the session as when joining, and tells everyone in the
+// session. Members may change their nick as often as they may chat.
+func (s *Session) SetNick(id string, nick string) (WireNick, error) {
+	nick = NormalizeNick(nick)
+	if nick == "" {
+		return WireNick{}, ErrInvalidNick
+	}
+	if utf8.RuneCountInString(nick) > NickMaxLength {
+		return WireNick{}, ErrNickTooLong
+	}
+
+	s.mu.Lock()
+	m, ok := s.Members[id]
+	if !ok {
+		s.mu.Unlock()
+		return WireNick{}, ErrNotMember
+	}
+	if !m.rename.allow(time.Now()) {
+		s.mu.Unlock()
+		return WireNick{}, ErrRateLimited
+	}
+	s.touch()
+
+	wn := WireNick{
+		SessionID: s.SessionID,
+		MemberID:  id,
+		Old:       m.Nick,
+		Nick:      s.uniqueNick(nick, id),
+	}
+	m.Nick = wn.Nick
+	s.mu.Unlock()
+
+	if wn.Nick == wn.Old {
+		return wn, nil
+	}
+
+	s.changed()
+	s.announce("flixy nick", wn)
+	return wn, nil
+}
@@ -0,0 +1,32 @@
+package models
+
+import "testing"
+
+func TestNormalizeNick(t *testing.T) {
+	for _, c := range []struct{ nick, want string }{
+		{"  bob \t the\u200b  builder ", "bob the builder"},
+		{"caf\u00e9", "caf\u00e9"},
+		{"cafe\u0301", "caf\u00e9"},
+		{"\uff41\uff4c\uff49\uff43\uff45", "alice"},
+		{"\u202e\x00", ""},
+	} {
+		if got := NormalizeNick(c.nick); got != c.want {
+			t.Errorf("NormalizeNick(%q) = %q, want %q", c.nick, got, c.want)
+		}
+	}
+}
+
+func TestUniqueNickNormalized(t *testing.T) {
+	st := newTestStore(t)
+
+	if _, err := st.Create("1", NetflixMedia(80018499), 0, newFakeSocket("a"), "caf\u00e9", SessionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := st.Join("1", newFakeSocket("b"), "cafe\u0301", Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "caf\u00e9 2"; m.Nick != want {
+		t.Errorf("got nick %q, want %q", m.Nick, want)
+	}
+}
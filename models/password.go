@@ -0,0 +1,272 @@
+package models
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPasswordRequired is returned when somebody who isn't a member of
+	// a password-protected session tries to join it, or see it, without
+	// giving its password or a session token.
+	ErrPasswordRequired = errors.New("password required")
+
+	// ErrWrongPassword is returned when the password or session token
+	// given for a session is not the right one.
+	ErrWrongPassword = errors.New("wrong password")
+)
+
+// Credentials are what somebody joining or looking at a session has to show
+// for themselves, on top of its ID.
+type Credentials struct {
+	// Invite is the ID of the invite they were given, if any, which lets
+	// them in whether or not the session has a password.
+	Invite string
+	// Password is the session's password, if it has one, and Token a
+	// session token (see `Session.Token`), which will do instead.
+	Password string
+	Token    string
+	// IP is the remote address they are connecting from, which mustn't
+	// be banned from the session.
+	IP string
+
+	// salt and hash are Password hashed with the session's salt by
+	// `Session.hash`, which has to happen before the session is locked to
+	// check them.
+	salt []byte
+	hash []byte
+}
+
+// WireSessionToken is the payload of `flixy session token`, which is sent to
+// everyone who creates or joins a session with a password.
+type WireSessionToken struct {
+	SessionID string `json:"session_id"`
+	Token     string `json:"token"`
+}
+
+var (
+	// PasswordBurst is how many passwords may be tried from one IP
+	// address in a row before being rate limited, across every session.
+	PasswordBurst = 5
+
+	// PasswordInterval is how often a rate limited IP address earns
+	// another try, up to `PasswordBurst`.
+	PasswordInterval = 10 * time.Second
+)
+
+// passwordTries limits how fast passwords may be tried from each IP address,
+// as hashing each one is slow enough on purpose that anybody could keep the
+// server busy with them otherwise.
+var passwordTries = &triesLimiter{limiters: make(map[string]*chatLimiter)}
+
+// triesLimiter is a token bucket for each IP address.
+type triesLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*chatLimiter
+}
+
+// triesTracked is how many IP addresses a `triesLimiter` keeps buckets for
+// before it forgets those which are full again.
+const triesTracked = 1024
+
+// allow takes a token from the bucket of the given IP address if there is
+// one, returning whether there was.
+func (t *triesLimiter) allow(ip string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.limiters) >= triesTracked {
+		full := time.Duration(PasswordBurst) * PasswordInterval
+		for k, l := range t.limiters {
+			if now.Sub(l.last) >= full {
+				delete(t.limiters, k)
+			}
+		}
+	}
+
+	l, ok := t.limiters[ip]
+	if !ok {
+		l = &chatLimiter{}
+		t.limiters[ip] = l
+	}
+	return l.allowAt(now, PasswordBurst, PasswordInterval)
+}
+
+// passwordIterations is how many rounds of PBKDF2 passwords are hashed with.
+// Hashing one takes in the order of a hundred milliseconds, to make guessing
+// the password of a session from its hash too slow to be worth it.
+const passwordIterations = 600000
+
+// hashPassword returns the hash of the given password with the given salt.
+// It is slow, so it must never be called holding a lock.
+func hashPassword(salt []byte, password string) []byte {
+	hash, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, sha256.Size)
+	if err != nil {
+		// This only happens for key lengths no SHA-256 key could have.
+		panic(err)
+	}
+	return hash
+}
+
+// hash hashes the password in the given credentials, if any, with the
+// session's salt, so that `authenticate` can check it without hashing it
+// while holding the session's lock. Members of the session, such as the one
+// with the given ID, have shown their credentials already, so theirs aren't
+// hashed again. It returns `ErrRateLimited` if passwords are being tried
+// from the credentials' IP address too fast. It must be called without
+// holding the session's lock.
+func (s *Session) hash(c *Credentials, id string) error {
+	if c.Password == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	salt := s.salt
+	member := s.hasMember(id)
+	s.mu.Unlock()
+
+	if salt == nil || member {
+		return nil
+	}
+	if !passwordTries.allow(banIP(c.IP), time.Now()) {
+		return ErrRateLimited
+	}
+	c.salt = salt
+	c.hash = hashPassword(salt, c.Password)
+	return nil
+}
+
+// newPassword returns a new salt and the hash of the given password with it,
+// or nothing if the password is empty.
+func newPassword(password string) ([]byte, []byte, error) {
+	if password == "" {
+		return nil, nil, nil
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	return salt, hashPassword(salt, password), nil
+}
+
+// SetPassword sets the session's password on behalf of its host, so that
+// nobody else can join it or see it without the password or a session
+// token. An empty password takes the protection off again. Changing the
+// password makes every session token given out so far stop working, but
+// leaves everyone who is already a member where they are.
+func (s *Session) SetPassword(by string, password string) error {
+	salt, hash, err := newPassword(password)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if err := s.hostOnly(by); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.salt = salt
+	s.password = hash
+	s.version++
+	s.mu.Unlock()
+
+	s.changed()
+	s.Sync()
+	return nil
+}
+
+// Token returns a session token for the session, with which anybody can join
+// it or see it without its password until the password changes, or an empty
+// string if it has no password.
+func (s *Session) Token() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.token()
+}
+
+// token is `Token` for callers already holding the session's lock.
+func (s *Session) token() string {
+	if s.password == nil {
+		return ""
+	}
+	return sign("session." + s.SessionID + "." + hex.EncodeToString(s.password))
+}
+
+// authenticate returns why somebody with the given credentials, leaving
+// their invite aside, may not join or see the session, if they may not. The
+// credentials must have been through `hash`, and a password hashed before the
+// session's password last changed counts as wrong. The caller must hold the
+// session's lock.
+func (s *Session) authenticate(c Credentials) error {
+	if s.password == nil {
+		return nil
+	}
+
+	switch {
+	case c.Password != "":
+		if bytes.Equal(c.salt, s.salt) && hmac.Equal(c.hash, s.password) {
+			return nil
+		}
+	case c.Token != "":
+		if hmac.Equal([]byte(s.token()), []byte(c.Token)) {
+			return nil
+		}
+	default:
+		return ErrPasswordRequired
+	}
+	return ErrWrongPassword
+}
+
+// Authorize returns why the socket with the given ID may not see the
+// session, given the credentials it sent, if it may not. Members may always
+// see the session they are in, having shown their credentials to join it.
+func (s *Session) Authorize(id string, c Credentials) error {
+	if err := s.hash(&c, id); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.hasMember(id) {
+		return nil
+	}
+	return s.authenticate(c)
+}
+
+// admit checks that somebody with the given credentials may join the
+// session, and hasn't been banned from it, using up their invite if they have one, and returns whether that
+// changed the state of the session. It is called by the store with its lock
+// held, so the caller must call `changed` once it has released it if so, and
+// have put the credentials through `hash` before taking it.
+func (s *Session) admit(c Credentials) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.banned(c.IP, "") {
+		return false, ErrBanned
+	}
+	if c.Invite == "" {
+		return false, s.authenticate(c)
+	}
+
+	wi, ok := s.invites[c.Invite]
+	if !ok {
+		return false, ErrInviteRevoked
+	}
+	if err := wi.usable(time.Now()); err != nil {
+		return false, err
+	}
+	wi.Uses++
+	s.invites[c.Invite] = wi
+	return true, nil
+}
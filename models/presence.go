@@ -0,0 +1,130 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInvalidMemberState is returned for member states flixy doesn't know
+// about.
+var ErrInvalidMemberState = errors.New("invalid member state")
+
+// MemberState is what a member's player is doing, as reported by the member.
+type MemberState string
+
+// These are the states a member can report.
+const (
+	// StatePlaying means the member's player is playing.
+	StatePlaying MemberState = "playing"
+	// StateBuffering means the member's player is waiting for more of the
+	// video to load.
+	StateBuffering MemberState = "buffering"
+	// StatePaused means the member's player is paused.
+	StatePaused MemberState = "paused"
+)
+
+// DefaultAutoPause is whether new sessions which don't say otherwise pause
+// while any of their members is buffering.
+var DefaultAutoPause = false
+
+// Valid returns whether the state is one flixy knows about.
+func (st MemberState) Valid() bool {
+	switch st {
+	case StatePlaying, StateBuffering, StatePaused:
+		return true
+	}
+	return false
+}
+
+// SetMemberState records the state and position of the member with the given
+// ID's player, as reported by the member, pausing or resuming the session if
+// it auto-pauses.
+func (s *Session) SetMemberState(id string, st MemberState, pos int) error {
+	if !st.Valid() {
+		return ErrInvalidMemberState
+	}
+
+	s.mu.Lock()
+	m, ok := s.Members[id]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotMember
+	}
+	moved := m.state != st
+	m.state = st
+	m.position = pos
+	m.reported = time.Now()
+	s.touch()
+	held := s.hold()
+	wm := m.ToWireMember()
+	s.mu.Unlock()
+
+	// Positions are reported far too often to send around every time,
+	// so the others only hear about them along with a change of state.
+	if !moved && !held {
+		return nil
+	}
+
+	s.publish(busMessage{Kind: "member", MemberID: id, Member: &wm})
+	if held {
+		s.changed()
+	}
+	s.Sync()
+	return nil
+}
+
+// SetAutoPause sets whether the session pauses while any of its members is
+// buffering, on behalf of its host.
+func (s *Session) SetAutoPause(by string, on bool) error {
+	s.mu.Lock()
+	if err := s.hostOnly(by); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.autoPause = on
+	s.version++
+	s.hold()
+	s.mu.Unlock()
+
+	s.changed()
+	s.Sync()
+	return nil
+}
+
+// buffering returns whether any member of the session, on this server or
+// another, is buffering, leaving aside those who are away. The caller must hold the session's lock.
+func (s *Session) buffering() bool {
+	for _, m := range s.Members {
+		if !m.away && m.state == StateBuffering {
+			return true
+		}
+	}
+	for _, wm := range s.remote {
+		if !wm.Away && wm.State == StateBuffering {
+			return true
+		}
+	}
+	return false
+}
+
+// hold pauses the session if it auto-pauses and somebody is buffering, or
+// resumes it if it was paused that way and nobody is any more, returning
+// whether it did either. A session somebody has paused by hand is left
+// paused. The caller must hold the session's lock.
+func (s *Session) hold() bool {
+	buffering := s.autoPause && s.buffering()
+
+	switch {
+	case buffering && !s.clock.Paused():
+		s.clock.Pause()
+		s.held = true
+		s.version++
+		return true
+	case !buffering && s.held:
+		s.clock.Play()
+		s.held = false
+		s.version++
+		return true
+	}
+	return false
+}
@@ -0,0 +1,316 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when enqueueing onto a session whose queue
+	// already has `QueueLimit` videos in it.
+	ErrQueueFull = errors.New("queue is full")
+
+	// ErrQueueEmpty is returned when advancing a session with nothing
+	// queued up.
+	ErrQueueEmpty = errors.New("queue is empty")
+
+	// ErrNoSuchItem is returned when a command refers to a video that is
+	// not in the session's queue.
+	ErrNoSuchItem = errors.New("no such queue item")
+)
+
+// QueueLimit is how many videos may be queued up in a session at once.
+var QueueLimit = 100
+
+// WireQueueItem is a video queued up to be watched in a session.
+type WireQueueItem struct {
+	ID string `json:"id"`
+	// VideoID is the Netflix video ID of Media, for older clients.
+	VideoID int   `json:"video_id"`
+	Media   Media `json:"media"`
+	// Duration is how long the video is, in milliseconds, or 0 if
+	// whoever queued it up didn't say.
+	Duration int    `json:"duration"`
+	AddedBy  string `json:"added_by"`
+}
+
+// WireVideoChange is the payload of `flixy video changed`, which tells every
+// member of a session that it has moved on to another video. The embedded
+// action says who changed it, and at what time the new video starts; it is
+// empty if the session moved on by itself because the last video ended.
+type WireVideoChange struct {
+	VideoID  int    `json:"video_id"`
+	Media    Media  `json:"media"`
+	Duration int    `json:"duration"`
+	URL      string `json:"url"`
+	WireAction
+}
+
+// randomID returns a new random ID for a queue item or annotation.
+func randomID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Enqueue adds the given media of the given duration to the end of the session's
+// queue, on behalf of the member with the given ID.
+func (s *Session) Enqueue(by string, media Media, duration int) (WireQueueItem, error) {
+	if err := media.Validate(); err != nil {
+		return WireQueueItem{}, err
+	}
+	if duration < 0 {
+		duration = 0
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return WireQueueItem{}, err
+	}
+
+	s.mu.Lock()
+	if len(s.queue) >= QueueLimit {
+		s.mu.Unlock()
+		return WireQueueItem{}, ErrQueueFull
+	}
+	item := WireQueueItem{
+		ID:       id,
+		VideoID:  media.VideoID(),
+		Media:    media,
+		Duration: duration,
+		AddedBy:  by,
+	}
+	s.queue = append(s.queue, item)
+	s.version++
+	s.mu.Unlock()
+
+	s.changed()
+	s.Sync()
+	return item, nil
+}
+
+// findItem returns the index of the queue item with the given ID. The caller
+// must hold the session's lock.
+func (s *Session) findItem(id string) (int, error) {
+	for i, item := range s.queue {
+		if item.ID == id {
+			return i, nil
+		}
+	}
+	return 0, ErrNoSuchItem
+}
+
+// Reorder moves the queue item with the given ID to the given index of the
+// session's queue, or as near to it as there is, on behalf of the member with
+// the given ID, who must be able to control the session. Versions are checked
+// as in `SetTime`.
+func (s *Session) Reorder(by string, id string, index int, version *int64) error {
+	s.mu.Lock()
+	if err := s.canControl(by); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if err := s.checkVersion(version); err != nil {
+		s.mu.Unlock()
+		s.resync(by)
+		return err
+	}
+	i, err := s.findItem(id)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	item := s.queue[i]
+	s.queue = append(s.queue[:i], s.queue[i+1:]...)
+	if index < 0 {
+		index = 0
+	}
+	if index > len(s.queue) {
+		index = len(s.queue)
+	}
+	s.queue = append(s.queue, WireQueueItem{})
+	copy(s.queue[index+1:], s.queue[index:])
+	s.queue[index] = item
+	s.version++
+	s.mu.Unlock()
+
+	s.changed()
+	s.Sync()
+	return nil
+}
+
+// Dequeue removes the queue item with the given ID from the session's queue,
+// on behalf of the member with the given ID, who must be able to control the
+// session. Versions are checked as in `SetTime`.
+func (s *Session) Dequeue(by string, id string, version *int64) error {
+	s.mu.Lock()
+	if err := s.canControl(by); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if err := s.checkVersion(version); err != nil {
+		s.mu.Unlock()
+		s.resync(by)
+		return err
+	}
+	i, err := s.findItem(id)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	s.queue = append(s.queue[:i], s.queue[i+1:]...)
+	s.version++
+	s.mu.Unlock()
+
+	s.changed()
+	s.Sync()
+	return nil
+}
+
+// Advance moves the session on to the first video in its queue, on behalf of
+// the member with the given ID. Versions are checked as in `SetTime`.
+func (s *Session) Advance(by string, version *int64) error {
+	s.mu.Lock()
+	if err := s.checkVersion(version); err != nil {
+		s.mu.Unlock()
+		s.resync(by)
+		return err
+	}
+	if len(s.queue) == 0 {
+		s.mu.Unlock()
+		return ErrQueueEmpty
+	}
+	wvc := s.advance(by)
+	s.mu.Unlock()
+
+	s.videoChanged(wvc)
+	return nil
+}
+
+// advance is `Advance` for callers already holding the session's lock, which
+// have checked that the queue isn't empty. The caller must call
+// `videoChanged` with the result once it has released the lock.
+func (s *Session) advance(by string) WireVideoChange {
+	item := s.queue[0]
+	s.queue = append([]WireQueueItem(nil), s.queue[1:]...)
+
+	return s.changeVideo(by, item.Media, 0, item.Duration)
+}
+
+// ChangeVideo switches the session to the given media of the given duration
+// (0 if unknown), starting paused at the given time, on behalf of the member
+// with the given ID. Versions are checked as in `SetTime`.
+func (s *Session) ChangeVideo(by string, media Media, ts int, duration int, version *int64) error {
+	if err := media.Validate(); err != nil {
+		return err
+	}
+	if duration < 0 {
+		duration = 0
+	}
+
+	s.mu.Lock()
+	if err := s.checkVersion(version); err != nil {
+		s.mu.Unlock()
+		s.resync(by)
+		return err
+	}
+	s.clock.Pause()
+	s.held = false
+	wvc := s.changeVideo(by, media, ts, duration)
+	s.mu.Unlock()
+
+	s.videoChanged(wvc)
+	return nil
+}
+
+// changeVideo switches the session to the given media at the given time,
+// carrying on playing if it was, on behalf of the member with the given ID.
+// The caller must hold the session's lock, and call `videoChanged` with the
+// result once it has released it.
+func (s *Session) changeVideo(by string, media Media, ts int, duration int) WireVideoChange {
+	s.Media = media
+	s.duration = duration
+	s.clock.Set(ts)
+	s.version++
+
+	return WireVideoChange{
+		VideoID:    media.VideoID(),
+		Media:      media,
+		Duration:   duration,
+		URL:        media.WatchURL(s.SessionID),
+		WireAction: s.action(by),
+	}
+}
+
+// videoChanged tells everyone that the session has changed video. It must be
+// called without holding the session's lock.
+func (s *Session) videoChanged(wvc WireVideoChange) {
+	s.changed()
+	s.announce("flixy video changed", wvc)
+	s.Sync()
+}
+
+// scheduleEnd arranges for the session to advance to the next video in its
+// queue once the current one ends, if it is playing, the length of the
+// current video is known and there is anything queued up. Only the server
+// the host is connected to does this, so that the session doesn't advance
+// once for every server it is on. It must be called without holding the
+// session's lock, whenever any of those things might have changed.
+func (s *Session) scheduleEnd() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.end != nil {
+		s.end.Stop()
+		s.end = nil
+	}
+
+	_, host := s.Members[s.host]
+	if !host || s.clock.Paused() || s.duration <= 0 || len(s.queue) == 0 {
+		return
+	}
+
+	left := float64(s.duration - s.clock.Now())
+	if left < 0 {
+		left = 0
+	}
+	d := time.Duration(left / s.clock.rate * float64(time.Millisecond))
+
+	s.endGen++
+	gen := s.endGen
+	s.end = time.AfterFunc(d, func() { s.ended(gen) })
+}
+
+// stopEnd cancels advancing the session once the current video ends, if that
+// had been arranged.
+func (s *Session) stopEnd() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.end != nil {
+		s.end.Stop()
+		s.end = nil
+	}
+}
+
+// ended advances the session once the current video has ended, unless the
+// timer of the given generation, which went off for it, has since been
+// stopped or replaced.
+func (s *Session) ended(gen int) {
+	s.mu.Lock()
+	if s.end == nil || s.endGen != gen || len(s.queue) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	s.end = nil
+	wvc := s.advance("")
+	s.mu.Unlock()
+
+	s.videoChanged(wvc)
+}
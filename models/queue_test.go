@@ -0,0 +1,57 @@
+package models
+
+import "testing"
+
+func TestQueueChangesConflict(t *testing.T) {
+	st := newTestStore(t)
+	host, bob := newFakeSocket("a"), newFakeSocket("b")
+
+	s, err := st.Create("1", NetflixMedia(80018499), 0, host, "alice", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Join("1", bob, "bob", Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	var items []WireQueueItem
+	for _, id := range []int{70143836, 80057281, 80117540} {
+		item, err := s.Enqueue("a", NetflixMedia(id), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+
+	// Both saw the same version, so whoever comes second is refused.
+	v := s.Version()
+	if err := s.Reorder("a", items[2].ID, 0, &v); err != nil {
+		t.Fatal(err)
+	}
+	syncs := bob.sent("flixy sync")
+	if err := s.Reorder("b", items[1].ID, 0, &v); err != ErrConflict {
+		t.Errorf("got error %v reordering, want %v", err, ErrConflict)
+	}
+	if err := s.Dequeue("b", items[0].ID, &v); err != ErrConflict {
+		t.Errorf("got error %v dequeueing, want %v", err, ErrConflict)
+	}
+	if n := bob.sent("flixy sync") - syncs; n != 2 {
+		t.Errorf("refused member was sent %d flixy sync, want 2", n)
+	}
+	if q := s.GetWireSession().Queue; len(q) != 3 || q[0].ID != items[2].ID {
+		t.Errorf("queue was changed by a stale version: %+v", q)
+	}
+
+	if err := s.Dequeue("b", items[0].ID, nil); err != nil {
+		t.Errorf("dequeueing without a version: %v", err)
+	}
+
+	if err := s.SetPolicy("a", PolicyHost); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reorder("b", items[1].ID, 0, nil); err != ErrForbidden {
+		t.Errorf("got error %v reordering without control, want %v", err, ErrForbidden)
+	}
+	if err := s.Dequeue("b", items[1].ID, nil); err != ErrForbidden {
+		t.Errorf("got error %v dequeueing without control, want %v", err, ErrForbidden)
+	}
+}
@@ -0,0 +1,57 @@
+package models
+
+import "errors"
+
+// ErrInvalidRate is returned for playback rates that aren't positive.
+var ErrInvalidRate = errors.New("invalid playback rate")
+
+var (
+	// MinRate and MaxRate are the slowest and fastest sessions may be
+	// played. Rates outside of them are clamped to them.
+	MinRate = 0.75
+	MaxRate = 2.0
+)
+
+// clampRate returns the given rate clamped to between `MinRate` and
+// `MaxRate`.
+func clampRate(rate float64) float64 {
+	if rate < MinRate {
+		return MinRate
+	}
+	if rate > MaxRate {
+		return MaxRate
+	}
+	return rate
+}
+
+// Rate returns the rate the session is played at, where 1 is normal speed.
+func (s *Session) Rate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.clock.rate
+}
+
+// SetRate sets the rate the session is played at, clamped to between
+// `MinRate` and `MaxRate`, on behalf of the member with the given ID, and
+// returns the rate it was set to. Versions are checked as in `SetTime`.
+func (s *Session) SetRate(by string, rate float64, version *int64) (float64, error) {
+	if rate <= 0 {
+		return 0, ErrInvalidRate
+	}
+	rate = clampRate(rate)
+
+	s.mu.Lock()
+	if err := s.checkVersion(version); err != nil {
+		s.mu.Unlock()
+		s.resync(by)
+		return 0, err
+	}
+	s.version++
+	s.clock.SetRate(rate)
+	s.mu.Unlock()
+
+	s.changed()
+	s.Sync()
+	return rate, nil
+}
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"time"
+
+	log "github.com/flixy/flixy/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/flixy/flixy/Godeps/_workspace/src/github.com/googollee/go-socket.io"
+)
+
+var (
+	// EmptyTTL is how long a session is kept once its last member has
+	// left, so that somebody (e.g. its host, having refreshed the page)
+	// can join it again. If it is 0, sessions are deleted as soon as they
+	// are empty.
+	EmptyTTL = 5 * time.Minute
+
+	// IdleTimeout is how long a session may go without anybody in it
+	// doing anything before it expires, whether or not it has members.
+	// If it is 0, sessions never expire for being idle.
+	IdleTimeout = 6 * time.Hour
+
+	// ReapInterval is how often stores look for sessions which have
+	// expired.
+	ReapInterval = 10 * time.Second
+)
+
+// ExpiryReason is why a session expired.
+type ExpiryReason string
+
+// These are the reasons a session can expire for.
+const (
+	// ExpiryEmpty means nobody joined the session for `EmptyTTL` after
+	// its last member left.
+	ExpiryEmpty ExpiryReason = "empty"
+	// ExpiryIdle means nobody in the session did anything for
+	// `IdleTimeout`.
+	ExpiryIdle ExpiryReason = "idle"
+)
+
+// WireExpiry is the payload of `flixy session expired`, which is sent to every
+// member of a session when it expires.
+type WireExpiry struct {
+	SessionID string       `json:"session_id"`
+	Reason    ExpiryReason `json:"reason"`
+}
+
+// touch records that something has just happened in the session. The caller
+// must hold the session's lock.
+func (s *Session) touch() {
+	s.active = time.Now()
+}
+
+// expiry returns why the session has expired by the given time, if it has.
+func (s *Session) expiry(now time.Time) (ExpiryReason, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idle := now.Sub(s.active)
+	switch {
+	case len(s.Members) == 0 && idle >= EmptyTTL:
+		return ExpiryEmpty, true
+	case IdleTimeout > 0 && idle >= IdleTimeout:
+		return ExpiryIdle, true
+	}
+	return "", false
+}
+
+// reaper expires sessions every interval, for ever.
+func (st *MemoryStore) reaper(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for now := range t.C {
+		st.reap(now)
+	}
+}
+
+// expiry is a session expiring, as recorded by `reap` for it to announce
+// once the store's lock has been released.
+type expiry struct {
+	s      *Session
+	reason ExpiryReason
+	age    time.Duration
+	socks  []socketio.Socket
+}
+
+// reap deletes every session in the store which has expired by the given
+// time, telling its members why.
+func (st *MemoryStore) reap(now time.Time) {
+	st.mu.Lock()
+	var es []expiry
+	for _, s := range st.sessions {
+		reason, ok := s.expiry(now)
+		if !ok {
+			continue
+		}
+
+		s.mu.Lock()
+		age := now.Sub(s.created)
+		s.mu.Unlock()
+
+		es = append(es, expiry{s, reason, age, st.drop(s)})
+	}
+	st.mu.Unlock()
+
+	for _, e := range es {
+		e.s.stop()
+
+		we := WireExpiry{SessionID: e.s.SessionID, Reason: e.reason}
+		for _, so := range e.socks {
+			so.Emit("flixy session expired", we)
+		}
+
+		log.WithFields(log.Fields{
+			"session_id":                   e.s.SessionID,
+			"reason":                       e.reason,
+			"members":                      len(e.socks),
+			"count#flixy.sessions.expired": 1,
+			"measure#flixy.sessions.age":   int(e.age.Seconds()),
+		}).Info("session expired")
+	}
+
+	if len(es) > 0 {
+		st.changed()
+	}
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReapEmpty(t *testing.T) {
+	st := newTestStore(t)
+	EmptyTTL = time.Minute
+
+	if _, err := st.Create("1", NetflixMedia(80018499), 0, newFakeSocket("a"), "alice", SessionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	st.Leave("a")
+	left := time.Now()
+
+	st.reap(left.Add(EmptyTTL / 2))
+	if _, ok := st.Get("1"); !ok {
+		t.Fatal("session was reaped before EmptyTTL")
+	}
+	st.reap(left.Add(EmptyTTL))
+	if _, ok := st.Get("1"); ok {
+		t.Error("empty session wasn't reaped after EmptyTTL")
+	}
+}
+
+func TestReapIdle(t *testing.T) {
+	st := newTestStore(t)
+	IdleTimeout = time.Hour
+	so := newFakeSocket("a")
+
+	if _, err := st.Create("1", NetflixMedia(80018499), 0, so, "alice", SessionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now()
+
+	st.reap(created.Add(IdleTimeout / 2))
+	if _, ok := st.Get("1"); !ok {
+		t.Fatal("session with a member was reaped before IdleTimeout")
+	}
+	st.reap(created.Add(IdleTimeout))
+	if _, ok := st.Get("1"); ok {
+		t.Error("idle session wasn't reaped after IdleTimeout")
+	}
+	if n := so.sent("flixy session expired"); n != 1 {
+		t.Errorf("member was sent %d flixy session expired, want 1", n)
+	}
+	if _, ok := st.Member("a"); ok {
+		t.Error("member of the reaped session is still in the store")
+	}
+}
+
+func TestReapRestored(t *testing.T) {
+	testSettings(t)
+	EmptyTTL = time.Minute
+
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	fs, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Create("1", NetflixMedia(80018499), 0, newFakeSocket("a"), "alice", SessionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fs.Flush()
+
+	again, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := time.Now()
+	s, ok := again.Get("1")
+	if !ok {
+		t.Fatal("session was not restored")
+	}
+	if n := s.Len(); n != 0 {
+		t.Fatalf("restored session has %d members, want 0", n)
+	}
+
+	again.reap(restored.Add(EmptyTTL))
+	if _, ok := again.Get("1"); ok {
+		t.Error("restored session nobody joined wasn't reaped after EmptyTTL")
+	}
+}
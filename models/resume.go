@@ -0,0 +1,108 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/flixy/flixy/Godeps/_workspace/src/github.com/googollee/go-socket.io"
+)
+
+// ErrInvalidResumeToken is returned when resuming a member with a token which
+// isn't theirs.
+var ErrInvalidResumeToken = errors.New("invalid resume token")
+
+// ResumeGrace is how long a member who has disconnected is kept in their
+// session as away, in case they reconnect and resume it, before they are
+// removed. If it is 0, members are removed as soon as they disconnect.
+var ResumeGrace = 30 * time.Second
+
+// WireResumeToken is the payload of `flixy resume token`, which is sent to
+// every member when they join a session, so that they can resume being the
+// same member with `flixy resume` should they be disconnected.
+type WireResumeToken struct {
+	SessionID string `json:"session_id"`
+	MemberID  string `json:"member_id"`
+	Token     string `json:"token"`
+}
+
+// newResumeToken returns a new random resume token.
+func newResumeToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic("reading random bytes failed: " + err.Error())
+	}
+	return hex.EncodeToString(token)
+}
+
+// socket returns the member's socket, which changes when they resume.
+func (m *Member) socket() socketio.Socket {
+	m.Session.mu.Lock()
+	defer m.Session.mu.Unlock()
+
+	return m.Socket
+}
+
+// wireMember returns the `WireMember` of the given member of the session.
+func (s *Session) wireMember(m *Member) WireMember {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return m.ToWireMember()
+}
+
+// goAway marks the given member of the session as away, resuming the session
+// if it was held paused for them buffering. It returns the generation of
+// their absence, to be passed to `stillAway`, and whether the state of the
+// session changed.
+func (s *Session) goAway(m *Member) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m.away = true
+	m.awayGen++
+	return m.awayGen, s.hold()
+}
+
+// stillAway returns whether the given member of the session is still away
+// since the absence of the given generation began, rather than having
+// resumed or been removed since.
+func (s *Session) stillAway(m *Member, gen int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Members[m.ID] == m && m.away && m.awayGen == gen
+}
+
+// resume rebinds the member of the session with the given ID to the given
+// socket if the given resume token is theirs, whether or not they are away.
+// It returns the member, the ID of the socket they had before, and whether
+// the state of the session changed.
+func (s *Session) resume(id string, token string, so socketio.Socket) (*Member, string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.banned(RemoteIP(so), token) {
+		return nil, "", false, ErrBanned
+	}
+
+	m, ok := s.Members[id]
+	if !ok {
+		return nil, "", false, ErrNoSuchMember
+	}
+	if !hmac.Equal([]byte(m.token), []byte(token)) {
+		return nil, "", false, ErrInvalidResumeToken
+	}
+
+	old := m.Socket.Id()
+	m.Socket = so
+	m.ip = RemoteIP(so)
+	m.away = false
+	m.awayGen++
+	// The new connection may well be nothing like the old one.
+	m.latency = latency{}
+
+	return m, old, s.hold(), nil
+}
@@ -0,0 +1,86 @@
+package models
+
+// LeaveReason is why a member is no longer in a session.
+type LeaveReason string
+
+// These are the reasons a member can be no longer in a session for.
+const (
+	// LeaveLeft means the member left the session, e.g. by joining
+	// another one.
+	LeaveLeft LeaveReason = "left"
+	// LeaveDisconnected means the member disconnected, and the server
+	// doesn't wait for anybody to resume.
+	LeaveDisconnected LeaveReason = "disconnected"
+	// LeaveKicked means the host kicked or banned the member. Nobody is
+	// sent a `WireMemberLeft` for it, since everyone is sent a `WireKick`
+	// instead.
+	LeaveKicked LeaveReason = "kicked"
+	// LeaveTimedOut means the member disconnected, and did not resume
+	// within `ResumeGrace`.
+	LeaveTimedOut LeaveReason = "timed_out"
+)
+
+// WireMemberJoined is the payload of `flixy member joined`, which is sent to
+// everyone else in a session when somebody joins it.
+type WireMemberJoined struct {
+	SessionID string     `json:"session_id"`
+	Member    WireMember `json:"member"`
+}
+
+// WireMemberLeft is the payload of `flixy member left`, which is sent to
+// everyone left in a session when somebody is no longer in it.
+type WireMemberLeft struct {
+	SessionID string      `json:"session_id"`
+	MemberID  string      `json:"member_id"`
+	Nick      string      `json:"nick"`
+	Reason    LeaveReason `json:"reason"`
+}
+
+// sendToOthers sends the given event to every member of the session who
+// isn't away, other than the one with the given ID. It must be called
+// without holding the session's lock.
+func (s *Session) sendToOthers(id string, eventName string, message interface{}) {
+	s.mu.Lock()
+	socks := s.sockets()
+	var own string
+	if m, ok := s.Members[id]; ok {
+		own = m.Socket.Id()
+	}
+	s.mu.Unlock()
+
+	for _, so := range socks {
+		if so.Id() != own {
+			so.Emit(eventName, message)
+		}
+	}
+}
+
+// memberJoined tells everyone else in the session, on this server and others,
+// that the given member has joined it. It must be called without holding the
+// session's lock.
+func (s *Session) memberJoined(m *Member) {
+	wm := s.wireMember(m)
+	s.publish(busMessage{Kind: "join", MemberID: m.ID, Member: &wm})
+	s.sendToOthers(m.ID, "flixy member joined", WireMemberJoined{
+		SessionID: s.SessionID,
+		Member:    wm,
+	})
+}
+
+// memberLeft tells everyone left in the session, on this server and others,
+// that the given member is no longer in it, and why, unless they were kicked
+// and so have been told already. It must be called without holding the
+// session's lock.
+func (s *Session) memberLeft(m *Member, reason LeaveReason) {
+	wm := s.wireMember(m)
+	s.publish(busMessage{Kind: "leave", MemberID: m.ID, Member: &wm, Reason: reason})
+	if reason == LeaveKicked {
+		return
+	}
+	s.SendToAll("flixy member left", WireMemberLeft{
+		SessionID: s.SessionID,
+		MemberID:  m.ID,
+		Nick:      wm.Nick,
+		Reason:    reason,
+	})
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flixy/flixy/broker"
+)
+
+// expectLeft checks that the given socket was sent exactly one `flixy member
+// left`, for the given member.
+func expectLeft(t *testing.T, so *fakeSocket, id string, nick string, reason LeaveReason) {
+	t.Helper()
+
+	ps := so.payloads("flixy member left")
+	if len(ps) != 1 {
+		t.Fatalf("%s was sent %d flixy member left, want 1", so.id, len(ps))
+	}
+	want := WireMemberLeft{SessionID: "1", MemberID: id, Nick: nick, Reason: reason}
+	if got, _ := ps[0].(WireMemberLeft); got != want {
+		t.Errorf("%s was sent %+v, want %+v", so.id, got, want)
+	}
+}
+
+// expectJoined checks that the given socket was sent exactly one `flixy
+// member joined`, for the given member.
+func expectJoined(t *testing.T, so *fakeSocket, id string, nick string) {
+	t.Helper()
+
+	ps := so.payloads("flixy member joined")
+	if len(ps) != 1 {
+		t.Fatalf("%s was sent %d flixy member joined, want 1", so.id, len(ps))
+	}
+	if got, _ := ps[0].(WireMemberJoined); got.Member.ID != id || got.Member.Nick != nick {
+		t.Errorf("%s was told %+v joined, want %s (%s)", so.id, got.Member, id, nick)
+	}
+}
+
+func TestMemberJoinedAndLeft(t *testing.T) {
+	st := newTestStore(t)
+	grace := ResumeGrace
+	ResumeGrace = 0
+	defer func() { ResumeGrace = grace }()
+
+	alice, bob, carol := newFakeSocket("a"), newFakeSocket("b"), newFakeSocket("c")
+	if _, err := st.Create("1", NetflixMedia(80018499), 0, alice, "alice", SessionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Join("1", bob, "bob", Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	expectJoined(t, alice, "b", "bob")
+	if n := bob.sent("flixy member joined"); n != 0 {
+		t.Errorf("joining member was sent %d flixy member joined, want 0", n)
+	}
+
+	if _, err := st.Join("1", carol, "carol", Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	st.Leave("b")
+	expectLeft(t, alice, "b", "bob", LeaveLeft)
+	expectLeft(t, carol, "b", "bob", LeaveLeft)
+
+	st.Disconnect("c")
+	if n := len(alice.payloads("flixy member left")); n != 2 {
+		t.Fatalf("alice was sent %d flixy member left, want 2", n)
+	}
+	want := WireMemberLeft{SessionID: "1", MemberID: "c", Nick: "carol", Reason: LeaveDisconnected}
+	if got := alice.payloads("flixy member left")[1]; got != want {
+		t.Errorf("alice was sent %+v, want %+v", got, want)
+	}
+}
+
+func TestMemberJoinedAndLeftFromReplica(t *testing.T) {
+	here, there := newTestStore(t), NewMemoryStore()
+	b := broker.NewLocal()
+	here.UseBus(NewBus(b))
+	there.UseBus(NewBus(b))
+
+	alice, bob := newFakeSocket("a"), newFakeSocket("b")
+	if _, err := here.Create("1", NetflixMedia(80018499), 0, alice, "alice", SessionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := there.Join("1", bob, "bob", Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "alice to hear bob joined", func() bool { return alice.sent("flixy member joined") > 0 })
+
+	there.Leave("b")
+	eventually(t, "alice to hear bob left", func() bool { return alice.sent("flixy member left") > 0 })
+
+	// Give any duplicates time to arrive.
+	time.Sleep(20 * time.Millisecond)
+	expectJoined(t, alice, "b", "bob")
+	expectLeft(t, alice, "b", "bob", LeaveLeft)
+}
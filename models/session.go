@@ -1,169 +1,462 @@
 package models
 
 import (
-	"fmt"
-	"net/url"
+	"sync"
 	"time"
 
-	"github.com/flixy/flixy/Godeps/_workspace/src/github.com/e-dard/tock"
 	"github.com/flixy/flixy/Godeps/_workspace/src/github.com/googollee/go-socket.io"
+	"github.com/flixy/flixy/broker"
 )
 
 // Session is the *internal* representation of a flixy session, which is a
 // collection of *Members*, along with:
-//   - A single Session ID, which is the name by which this is referred (this is probably always going to be the key in the `sessions` map in `main.go`
-//   - A single Video ID (a session can only be watching one thing at a time)
-//   - A single Time, which is a JS time in milliseconds (recorded as an `int`, but is that enough for a JS timestamp (which is milliseconds)?) Possible TODO is to make this a Time in the internal rep.
-//   - A bool indicating whether or not the session is currently paused
+//   - A single Session ID, which is the name by which this is referred (this is always the key in the `SessionStore` it lives in)
+//   - A single video, as `Media` (a session can only be watching one thing at a time), and a queue of videos to watch after it
+//   - A playback clock, from which the current time (a JS time in milliseconds), whether or not the session is paused and the rate it is played at are derived
+//   - A host, who is the member who created it until they hand it over or leave, and a `ControlPolicy` deciding who else may play, pause and seek
+//
+// A Session is safe for use by multiple goroutines; `Members` must only be
+// touched while holding the session's lock, which the methods below do for
+// you.
+//
+// `Members` only holds the members connected to this server. If the session
+// is attached to a `Bus`, the members connected to other servers are kept
+// in `remote`, and only show up in its `WireSession`.
 type Session struct {
 	SessionID string             `json:"session_id"`
-	VideoID   int                `json:"video_id"`
-	Time      int                `json:"time"`
+	Media     Media              `json:"media"`
 	Members   map[string]*Member `json:"members"`
-	Paused    bool               `json:"paused"`
-	ticker    *tock.Ticker
+	clock     *clock
+	mu        sync.Mutex
+
+	host   string
+	policy ControlPolicy
+	grants map[string]bool
+
+	// chat is the most recent `ChatHistoryLength` chat messages, and
+	// chatCount the number of chat messages ever sent.
+	chat      []WireChat
+	chatCount int
+
+	// autoPause is whether the session pauses while any of its members
+	// is buffering, and held whether it is currently paused because of
+	// that.
+	autoPause bool
+	held      bool
+
+	// duration is how long the current video is, in milliseconds, or 0
+	// if nobody has said. queue is the videos to watch after it.
+	duration int
+	queue    []WireQueueItem
+
+	// end, if set, advances the session to the next video in its queue
+	// once the current one ends, and endGen counts how many times it has
+	// been set.
+	end    *time.Timer
+	endGen int
+
+	// seq is the sequence number of the last play, pause, seek or change
+	// of video, and version the version of the session's state (see
+	// `Version`).
+	seq     int64
+	version int64
+
+	// annotations are the reactions and comments pinned to the video, in
+	// order of time.
+	annotations []WireAnnotation
+
+	// invites are the session's outstanding invites, by ID.
+	invites map[string]WireInvite
+
+	// password is the salted hash of the session's password, with salt
+	// its salt, or nil if it has none.
+	password []byte
+	salt     []byte
+
+	// bans are the members banned from the session, by member ID.
+	bans map[string]Ban
+
+	// created is when the session was created, or restored, and active
+	// when anybody in it last did anything.
+	created time.Time
+	active  time.Time
+
+	// onChange, if set, is called whenever the state of the session
+	// changes, so that its store can persist it.
+	onChange func()
+
+	// onKick, if set, is called with every member of the session on this
+	// server who is kicked, so that its store can remove them.
+	onKick func(*Member, WireKick)
+
+	bus    *Bus
+	sub    broker.Subscription
+	inbox  *inbox
+	remote map[string]WireMember
+
+	// quit and done are non-nil while the session's heartbeat is
+	// running; closing quit stops it, and it closes done once it has.
+	quit chan struct{}
+	done chan struct{}
+
+	// found is non-nil while a replica created by `Bus.find` is waiting
+	// for another server to tell it the state of the session, and is
+	// closed once one does.
+	found chan struct{}
 }
 
 // WireSession is the *external* representation of a flixy session. It has no
 // references to anything that has an unexported field, as that currently
 // (2015-08-20) causes reflection errors.
-// It is comprised of the session ID, the video ID, the time, whether or not
-// the session is paused, and the members.
+// It is comprised of the session ID, the video (along with its Netflix video
+// ID, for older clients, and where to watch it), the time, whether or not
+// the session is paused, the rate it is played at, how long the video is, the
+// videos queued up after it, the members, which of them is the host, the control
+// policy, whether the session has a password, whether it auto-pauses and is
+// currently held paused for somebody buffering, how many chat messages have
+// been sent (the messages themselves are sent separately), the sequence
+// number of the last play, pause or seek, the version of the session's state,
+// and when the server worked all of this out.
 type WireSession struct {
 	SessionID string                `json:"session_id"`
 	VideoID   int                   `json:"video_id"`
+	Media     Media                 `json:"media"`
+	URL       string                `json:"url"`
 	Time      int                   `json:"time"`
 	Paused    bool                  `json:"paused"`
+	Rate      float64               `json:"rate"`
+	Duration  int                   `json:"duration"`
+	Queue     []WireQueueItem       `json:"queue"`
 	Members   map[string]WireMember `json:"members"`
+	Host      string                `json:"host"`
+	Policy    ControlPolicy         `json:"policy"`
+	Protected bool                  `json:"protected"`
+	AutoPause bool                  `json:"auto_pause"`
+	Held      bool                  `json:"held"`
+	ChatCount int                   `json:"chat_count"`
+	Seq       int64                 `json:"seq"`
+	Version   int64                 `json:"version"`
+
+	// ServerTime is when the server worked out Time, in milliseconds
+	// since the Unix epoch, so that clients can tell how long ago that
+	// was and extrapolate where the video is now.
+	ServerTime int64 `json:"server_time"`
 }
 
 // NewSession creates and return a new `Session` with the given arguments,
 // starting paused.
-func NewSession(id string, vid int, ts int) *Session {
+func NewSession(id string, media Media, ts int) *Session {
 	// TODO add an option to start unpaused?
+	now := time.Now()
 	s := Session{
-		id,
-		vid,
-		ts,
-		make(map[string]*Member),
-		true,
-		tock.NewTicker(time.Millisecond),
+		SessionID: id,
+		Media:     media,
+		Members:   make(map[string]*Member),
+		clock:     newClock(ts),
+		policy:    DefaultControlPolicy,
+		autoPause: DefaultAutoPause,
+		grants:    make(map[string]bool),
+		invites:   make(map[string]WireInvite),
+		bans:      make(map[string]Ban),
+		remote:    make(map[string]WireMember),
+		created:   now,
+		active:    now,
 	}
-	s.ticker.Stop()
 
-	// TODO run a select{} on this for a quit channel for when we delete
-	// the session, so we don't continue accumulating goroutines for no
-	// reason over the life of the application
+	return &s
+}
 
-	go func() {
-		for {
-			<-s.ticker.C
-			s.Time++
-		}
-	}()
+// SessionOptions are the settings a new session can be created with, which
+// its host could otherwise only change once it exists.
+type SessionOptions struct {
+	// Policy is the session's control policy, or `DefaultControlPolicy`
+	// if it is empty.
+	Policy ControlPolicy
+	// AutoPause is whether the session pauses while any of its members is
+	// buffering, or `DefaultAutoPause` if it is nil.
+	AutoPause *bool
+	// Password, if set, is needed to join or see the session.
+	Password string
+}
 
-	return &s
+// configure applies the given options, with the password already hashed, to
+// a session nobody else can see yet. The caller must hold the session's
+// lock.
+func (s *Session) configure(opts SessionOptions, salt []byte, hash []byte) {
+	if opts.Policy != "" {
+		s.policy = opts.Policy
+	}
+	if opts.AutoPause != nil {
+		s.autoPause = *opts.AutoPause
+	}
+	s.salt = salt
+	s.password = hash
+}
+
+// Time returns the current time of the session, in milliseconds.
+func (s *Session) Time() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.clock.Now()
+}
+
+// Paused returns whether or not the session is currently paused.
+func (s *Session) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.clock.Paused()
 }
 
-// SetTime will set the time of the session to the given int timestamp.
-func (s *Session) SetTime(ts int) {
-	s.Time = ts
+// SetTime will set the time of the session to the given int timestamp, on
+// behalf of the member with the given ID. If a version is given, it returns
+// `ErrConflict` instead if the session's state is no longer at it.
+func (s *Session) SetTime(by string, ts int, version *int64) error {
+	s.mu.Lock()
+	if err := s.checkVersion(version); err != nil {
+		s.mu.Unlock()
+		s.resync(by)
+		return err
+	}
+	s.version++
+	from := s.clock.Now()
+	s.clock.Set(ts)
+	wa := s.action(by)
+	wa.From = from
+	s.mu.Unlock()
+
+	s.changed()
+	s.announce("flixy seeked", wa)
 	s.Sync()
+	return nil
+}
+
+// changed tells the session's store and the other servers that the state of
+// the session has changed, and reschedules advancing to the next video. It
+// must be called without holding the session's lock.
+func (s *Session) changed() {
+	s.mu.Lock()
+	s.touch()
+	s.mu.Unlock()
+
+	s.persist()
+	s.publishState()
+	s.scheduleEnd()
+}
+
+// stop stops the session's heartbeat and any timer it has for the end of the
+// current video, and detaches it from its bus, once it has been removed from
+// its store. It must be called without holding the session's lock.
+func (s *Session) stop() {
+	s.stopHeartbeat()
+	s.stopEnd()
+	s.detach()
+}
+
+// persist calls the session's `onChange` hook, if it has one. It must be
+// called without holding the session's lock.
+func (s *Session) persist() {
+	s.mu.Lock()
+	f := s.onChange
+	s.mu.Unlock()
+
+	if f != nil {
+		f()
+	}
+}
+
+// sockets returns a snapshot of the sockets of every member of the session
+// who isn't away, so that they can be written to without holding the
+// session's lock. The caller must hold the lock.
+func (s *Session) sockets() []socketio.Socket {
+	socks := make([]socketio.Socket, 0, len(s.Members))
+	for _, m := range s.Members {
+		if !m.away {
+			socks = append(socks, m.Socket)
+		}
+	}
+	return socks
 }
 
 // SendToAll emits a given eventName on all member sockets, with the given
 // message. Please don't pass anything that has an unexported struct key
 // anywhere in it at all to this. go-socket.io will choke on it.
 func (s *Session) SendToAll(eventName string, message interface{}) {
-	for _, m := range s.Members {
-		m.Socket.Emit(eventName, message)
+	s.mu.Lock()
+	socks := s.sockets()
+	s.mu.Unlock()
+
+	for _, so := range socks {
+		so.Emit(eventName, message)
 	}
 }
 
-// Play starts the server-side ticker of a given Session and informs all
-// Members that it is time to resume playing again.
-func (s *Session) Play() {
-	s.ticker.Resume()
-	s.Paused = false
+// Play starts the server-side clock of a given Session on behalf of the
+// member with the given ID and informs all Members that it is time to resume
+// playing again. Playing a session which is held paused for somebody
+// buffering overrides the hold. Versions are checked as in `SetTime`.
+func (s *Session) Play(by string, version *int64) error {
+	s.mu.Lock()
+	if err := s.checkVersion(version); err != nil {
+		s.mu.Unlock()
+		s.resync(by)
+		return err
+	}
+	s.version++
+	s.clock.Play()
+	s.held = false
+	wa := s.action(by)
+	s.mu.Unlock()
 
-	// TODO should this have its own dedicated `flixy play` event?
+	s.changed()
+	s.announce("flixy played", wa)
 	s.Sync()
+	return nil
 }
 
-// Pause pauses the server-side ticker of a given `Session` and inform all
-// clients that they should be paused, too.
-func (s *Session) Pause() {
-	s.ticker.Stop()
-	s.Paused = true
+// Pause pauses the server-side clock of a given `Session` on behalf of the
+// member with the given ID and inform all clients that they should be paused,
+// too. A session paused this way stays paused once nobody is buffering any
+// more. Versions are checked as in `SetTime`.
+func (s *Session) Pause(by string, version *int64) error {
+	s.mu.Lock()
+	if err := s.checkVersion(version); err != nil {
+		s.mu.Unlock()
+		s.resync(by)
+		return err
+	}
+	s.version++
+	s.clock.Pause()
+	s.held = false
+	wa := s.action(by)
+	s.mu.Unlock()
 
-	// TODO should this have its own dedicated `flixy pause` event?
+	s.changed()
+	s.announce("flixy paused", wa)
 	s.Sync()
+	return nil
 }
 
 // GetWireSession returns a `WireSession` from a given `Session`, which is a
 // sanitized version of a session suitable for sending over a socket.io
 // connection.
 func (s *Session) GetWireSession() WireSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.wireSession()
+}
+
+// wireSession is `GetWireSession` for callers already holding the session's
+// lock.
+func (s *Session) wireSession() WireSession {
 	wms := make(map[string]WireMember)
+	for k, wm := range s.remote {
+		wms[k] = wm
+	}
 	for k, member := range s.Members {
 		wms[k] = member.ToWireMember()
 	}
+	for k, wm := range wms {
+		wm.Control = s.canControl(k) == nil
+		wms[k] = wm
+	}
+	now := time.Now()
 	return WireSession{
 		s.SessionID,
-		s.VideoID,
-		s.Time,
-		s.Paused,
+		s.Media.VideoID(),
+		s.Media,
+		s.Media.WatchURL(s.SessionID),
+		s.clock.at(now),
+		s.clock.Paused(),
+		s.clock.rate,
+		s.duration,
+		append([]WireQueueItem{}, s.queue...),
 		wms,
+		s.host,
+		s.policy,
+		s.password != nil,
+		s.autoPause,
+		s.held,
+		s.chatCount,
+		s.seq,
+		s.version,
+		unixMillis(now),
 	}
 }
 
 // Sync syncs all members of a given session to the session's idea of where
 // everyone should be.
 func (s *Session) Sync() {
-	// TODO should this be using `s.SendToAll` instead?
-	for _, member := range s.Members {
-		member.Sync()
-	}
+	s.SendToAll("flixy sync", s.GetWireSession())
 }
 
-// AddMember adds a member to the given session and syncs them to where the
-// server is.
-func (s *Session) AddMember(so socketio.Socket, nick string) *Member {
-	m := &Member{so, s, nick}
-	s.Members[so.Id()] = m
-	m.Sync()
+// addMember adds a member to the given session without telling anyone about
+// it, so that `SessionStore` can do so while holding its own lock. If the
+// session has no host, the new member becomes it.
+func (s *Session) addMember(so socketio.Socket, nick string) *Member {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Touching the member's socket directly feels wrong. This should
-	// probably become non-exported.
-	m.Socket.Emit("flixy join session", s.GetWireSession())
+	m := &Member{
+		Socket:  so,
+		Session: s,
+		Nick:    s.joinNick(nick, so.Id()),
+		ID:      so.Id(),
+		token:   newResumeToken(),
+		ip:      RemoteIP(so),
+		joined:  time.Now(),
+	}
+	s.Members[m.ID] = m
+	s.handOff()
+	s.touch()
 
 	return m
 }
 
-// RemoveMember removes a member from the given session and returns the number
-// of members left in it.
-func (s *Session) RemoveMember(id string) int {
+// removeMember removes a member from the given session without telling
+// anyone about it, so that `SessionStore` can do so while holding its own
+// lock. It returns the number of members left and whether the state of the
+// session changed as a result, i.e. it had to hand off to a new host or
+// stopped being held paused.
+func (s *Session) removeMember(id string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	delete(s.Members, id)
+	delete(s.grants, id)
+	s.touch()
+
+	handOff := s.handOff()
+	held := s.hold()
+
+	return len(s.Members), handOff || held
+}
+
+// Len returns the number of members in the session.
+func (s *Session) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	return len(s.Members)
 }
 
-// GetNetflixURL returns the Netflix URL to which a user should be redirected
-// to so that they will be on the same video as the server initially.
-func (s *Session) GetNetflixURL() string {
-	// is this totally overengineered? should I just string cat these
-	// together?
-	var u *url.URL
-	u, err := url.Parse("https://www.netflix.com")
-	if err != nil {
-		// something has gone *seriously* wrong
-		panic("URL parsing a simple URL failed")
-	}
+// WatchURL returns the URL to which a user should be redirected to so that
+// they will be on the same video as the server initially, with the session
+// ID set in it.
+func (s *Session) WatchURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Media.WatchURL(s.SessionID)
+}
 
-	u.Path += fmt.Sprintf("/watch/%d", s.VideoID)
-	params := url.Values{}
-	params.Add("flixySessionId", s.SessionID)
-	u.RawQuery = params.Encode()
+// Redirect returns whether the server may redirect people to the session's
+// `WatchURL` and `InviteURL`s, rather than only linking to them.
+func (s *Session) Redirect() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return u.String()
+	return s.Media.Redirect()
 }
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidSessionID is returned for session IDs that none of the
+// `IDFormats` could have generated.
+var ErrInvalidSessionID = errors.New("invalid session id")
+
+// IDFormat generates session IDs of a particular shape, and recognises IDs
+// of that shape.
+type IDFormat interface {
+	// Generate returns a new, random session ID.
+	Generate() (string, error)
+
+	// Valid returns whether the given ID could have been generated by
+	// this format.
+	Valid(id string) bool
+}
+
+// IDFormats are the formats session IDs can be generated in, by name.
+//
+// New IDs are only checked against the sessions of the server creating them,
+// as asking every other server would hold up each new session for as long as
+// `Bus.find` waits for an answer. Across servers, IDs are kept apart by being
+// random enough: "numeric" IDs have about 53 bits of randomness, "base32"
+// IDs 80 and "words" IDs about 40, so servers sharing sessions should use
+// one of the first two.
+var IDFormats = map[string]IDFormat{
+	"numeric": numericIDFormat{},
+	"base32":  base32IDFormat{},
+	"words":   wordsIDFormat{},
+}
+
+// ValidSessionID returns whether the given session ID could have been
+// generated by any of the `IDFormats`. Every format is accepted, rather than
+// only the one currently in use, so that sessions restored from before a
+// change of format can still be joined.
+func ValidSessionID(id string) bool {
+	for _, f := range IDFormats {
+		if f.Valid(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// randomInt returns a uniformly random int in [0, n) from crypto/rand.
+func randomInt(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
+
+// numericIDFormat generates IDs of the form "%04d-%04d-%04d-%04d", which is
+// what flixy has always used.
+type numericIDFormat struct{}
+
+var numericIDPattern = regexp.MustCompile(`^[0-9]{4}-[0-9]{4}-[0-9]{4}-[0-9]{4}$`)
+
+// Generate implements `IDFormat`.
+func (numericIDFormat) Generate() (string, error) {
+	groups := make([]interface{}, 4)
+	for i := range groups {
+		n, err := randomInt(10000)
+		if err != nil {
+			return "", err
+		}
+		groups[i] = n
+	}
+
+	return fmt.Sprintf("%04d-%04d-%04d-%04d", groups...), nil
+}
+
+// Valid implements `IDFormat`.
+func (numericIDFormat) Valid(id string) bool {
+	return numericIDPattern.MatchString(id)
+}
+
+// base32IDFormat generates IDs of 80 random bits, written as four groups of
+// four lowercase base32 characters.
+type base32IDFormat struct{}
+
+var base32IDPattern = regexp.MustCompile(`^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$`)
+
+// Generate implements `IDFormat`.
+func (base32IDFormat) Generate() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	s := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16], nil
+}
+
+// Valid implements `IDFormat`.
+func (base32IDFormat) Valid(id string) bool {
+	return base32IDPattern.MatchString(id)
+}
+
+// wordsIDFormat generates IDs of `idWordCount` words from `idWords` joined by
+// dashes, which are easier to read out to somebody than the others.
+type wordsIDFormat struct{}
+
+// idWordCount is how many words a `wordsIDFormat` ID has.
+const idWordCount = 5
+
+// Generate implements `IDFormat`.
+func (wordsIDFormat) Generate() (string, error) {
+	ws := make([]string, idWordCount)
+	for i := range ws {
+		n, err := randomInt(len(idWords))
+		if err != nil {
+			return "", err
+		}
+		ws[i] = idWords[n]
+	}
+
+	return strings.Join(ws, "-"), nil
+}
+
+// Valid implements `IDFormat`.
+func (wordsIDFormat) Valid(id string) bool {
+	ws := strings.Split(id, "-")
+	if len(ws) != idWordCount {
+		return false
+	}
+
+	for _, w := range ws {
+		if !idWordSet[w] {
+			return false
+		}
+	}
+	return true
+}
+
+// idWords are the words `wordsIDFormat` picks from. They must all be
+// lowercase, distinct and free of dashes.
+var idWords = []string{
+	"acorn", "adobe", "agate", "alder", "alpine", "amber", "anchor",
+	"anvil", "apple", "apricot", "arbor", "arch", "arrow", "aspen",
+	"atlas", "attic", "autumn", "avocado", "badger", "bagel", "bamboo",
+	"banjo", "barley", "basil", "bay", "beacon", "beaker", "beech",
+	"berry", "birch", "biscuit", "bison", "blossom", "bluff", "bobcat",
+	"bonsai", "boulder", "bramble", "brass", "breeze", "brook", "bubble",
+	"buckle", "butter", "cabin", "cactus", "camel", "candle", "canoe",
+	"canyon", "carrot", "cedar", "cello", "chalk", "cherry", "chess",
+	"chili", "cider", "cinder", "citrus", "clay", "clover", "cobalt",
+	"cocoa", "comet", "copper", "coral", "cotton", "cove", "coyote",
+	"crane", "crater", "cricket", "crystal", "cumin", "daisy", "dawn",
+	"delta", "denim", "desert", "dingo", "dolphin", "domino", "dove",
+	"drift", "drum", "dune", "eagle", "echo", "eel", "elbow", "elder",
+	"elm", "ember", "emu", "fable", "falcon", "fennel", "fern", "fiddle",
+	"fig", "finch", "fjord", "flint", "fog", "forest", "fossil", "fox",
+	"frost", "galaxy", "garnet", "gecko", "geyser", "ginger", "glacier",
+	"glade", "gnome", "goose", "gopher", "granite", "grape", "gravel",
+	"grove", "gull", "harbor", "hazel", "heron", "hickory", "hill",
+	"honey", "hornet", "husky", "igloo", "indigo", "iris", "ivory", "ivy",
+	"jade", "jasper", "jelly", "jester", "juniper", "kale", "kayak",
+	"kelp", "kettle", "kiwi", "koala", "lagoon", "lantern", "larch",
+	"lava", "lemon", "lentil", "lilac", "lime", "linen", "lizard",
+	"llama", "lobster", "lotus", "lynx", "magnet", "mango", "maple",
+	"marble", "marsh", "meadow", "melon", "mesa", "meteor", "mint",
+	"mist", "mole", "moose", "moss", "moth", "nectar", "nest", "nickel",
+	"nutmeg", "oak", "oasis", "oatmeal", "ocean", "olive", "onyx",
+	"orbit", "orca", "otter", "owl", "oyster", "paddle", "panda",
+	"papaya", "parrot", "peach", "pebble", "pecan", "pepper", "pickle",
+	"pine", "pixel", "plum", "polar", "pond", "poppy", "prairie", "prism",
+	"puffin", "pumpkin", "quail", "quartz", "quill", "rabbit", "radish",
+	"raven", "reef", "ridge", "river", "robin", "rocket", "rose", "ruby",
+	"saffron", "sage", "salmon", "sapphire", "satin", "sequoia", "shadow",
+	"shell", "sierra", "silver", "sparrow", "spruce", "squid", "star",
+	"stone", "storm", "sugar", "summit", "swan", "tango", "teal",
+	"thistle", "thunder", "tiger", "timber", "toffee", "topaz", "tulip",
+	"tundra", "turnip", "umber", "valley", "velvet", "violet", "walnut",
+	"walrus", "wasp", "willow", "wombat", "yak", "zebra", "zinnia",
+}
+
+// idWordSet is `idWords` as a set, for validation.
+var idWordSet = func() map[string]bool {
+	set := make(map[string]bool, len(idWords))
+	for _, w := range idWords {
+		set[w] = true
+	}
+	return set
+}()
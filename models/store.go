@@ -0,0 +1,548 @@
+package models
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/flixy/flixy/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/flixy/flixy/Godeps/_workspace/src/github.com/googollee/go-socket.io"
+)
+
+var (
+	// ErrSessionExists is returned when creating a session whose ID is
+	// already in use.
+	ErrSessionExists = errors.New("session id already in use")
+
+	// ErrNoSuchSession is returned when looking up or joining a session
+	// that does not exist.
+	ErrNoSuchSession = errors.New("no such session")
+)
+
+// SessionStore is the registry of every live session, and of which session
+// each connected socket is a member of. All of its operations are atomic and
+// implementations must be safe for use by multiple goroutines.
+type SessionStore interface {
+	// Create creates a new session with the given ID, media, time and
+	// options, with the given socket as its first member. It returns
+	// `ErrSessionExists` if the ID is already taken.
+	Create(id string, media Media, ts int, so socketio.Socket, nick string, opts SessionOptions) (*Session, error)
+
+	// Get returns the session with the given ID, if there is one.
+	Get(id string) (*Session, bool)
+
+	// Member returns the member that the given socket ID belongs to, if
+	// it is in a session.
+	Member(sockid string) (*Member, bool)
+
+	// Join adds the given socket to the session with the given ID,
+	// removing it from any session it was previously a member of, and
+	// syncs it. It returns `ErrNoSuchSession` if there is no such
+	// session, or why the given credentials don't let the socket join
+	// it, in which case it is left in whichever session it was in. If
+	// the socket is already a member of the session, it is only synced.
+	Join(id string, so socketio.Socket, nick string, c Credentials) (*Member, error)
+
+	// Leave removes the member with the given socket ID from whichever
+	// session it is in, deleting that session if it is now empty and
+	// `EmptyTTL` is 0; otherwise, it expires once it has been empty that
+	// long. It returns the member that was removed, if any.
+	Leave(sockid string) (*Member, bool)
+
+	// Disconnect marks the member with the given socket ID as away, and
+	// removes them as `Leave` does unless they resume within
+	// `ResumeGrace`. It returns the member that went away, if any.
+	Disconnect(sockid string) (*Member, bool)
+
+	// Resume rebinds the member of the session with the given ID who
+	// has the given resume token to the given socket, removing the
+	// socket from any session it was previously a member of, and syncs
+	// it. It returns `ErrNoSuchSession` or `ErrNoSuchMember` if there is
+	// no such session or member on this server, and
+	// `ErrInvalidResumeToken` if the token isn't theirs.
+	Resume(sid string, id string, token string, so socketio.Socket) (*Member, error)
+
+	// Delete removes the session with the given ID, along with all of its
+	// members.
+	Delete(id string)
+
+	// WireSessions returns a `WireSession` for every session in the
+	// store, keyed by session ID.
+	WireSessions() map[string]WireSession
+}
+
+// MemoryStore is a `SessionStore` which keeps everything in process memory,
+// and so loses every session when the server exits.
+//
+// If it is given a `Bus`, the sessions in it are shared with every other
+// server on the bus, and joining a session that only exists on another server
+// brings a replica of it into this store.
+//
+// The store's lock is always taken before a session's lock, never after.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+	members  map[string]*Member
+	bus      *Bus
+
+	// onChange, if set, is called whenever a session is created,
+	// deleted, joined, left or changes state.
+	onChange func()
+}
+
+// NewMemoryStore returns an empty `MemoryStore`.
+func NewMemoryStore() *MemoryStore {
+	return newMemoryStore(nil)
+}
+
+// newMemoryStore returns an empty `MemoryStore` with the given `onChange`
+// hook, which has to be set before the reaper starts.
+func newMemoryStore(onChange func()) *MemoryStore {
+	st := &MemoryStore{
+		sessions: make(map[string]*Session),
+		members:  make(map[string]*Member),
+		onChange: onChange,
+	}
+
+	if ReapInterval > 0 {
+		go st.reaper(ReapInterval)
+	}
+	return st
+}
+
+// UseBus shares the sessions in the store, and any created from now on, with
+// the other servers on the given bus.
+func (st *MemoryStore) UseBus(b *Bus) {
+	st.mu.Lock()
+	st.bus = b
+	sessions := make([]*Session, 0, len(st.sessions))
+	for _, s := range st.sessions {
+		sessions = append(sessions, s)
+	}
+	st.mu.Unlock()
+
+	for _, s := range sessions {
+		st.attach(s)
+	}
+}
+
+// changed calls the store's `onChange` hook, if it has one. It must be called
+// without holding the store's lock.
+func (st *MemoryStore) changed() {
+	if st.onChange != nil {
+		st.onChange()
+	}
+}
+
+// add puts an existing session, already attached to the store's bus if it
+// has one, into the store, hooking it up to the store's `onChange` and `kick`
+// and starting its heartbeat. The caller must hold the store's lock.
+func (st *MemoryStore) add(s *Session) {
+	s.mu.Lock()
+	s.onChange = st.changed
+	s.onKick = st.kick
+	s.mu.Unlock()
+
+	st.sessions[s.SessionID] = s
+	s.startHeartbeat(SyncInterval)
+}
+
+// attach attaches the given session to the store's bus, if the store has one
+// and the session isn't attached already. It must be called without holding
+// the store's lock, since subscribing waits for the broker.
+func (st *MemoryStore) attach(s *Session) {
+	st.mu.RLock()
+	b := st.bus
+	st.mu.RUnlock()
+
+	if b == nil {
+		return
+	}
+
+	s.mu.Lock()
+	attached := s.sub != nil
+	s.mu.Unlock()
+
+	if attached {
+		return
+	}
+
+	if err := s.attach(b); err != nil {
+		log.WithField("session_id", s.SessionID).Error(err)
+	}
+}
+
+// find asks the store's bus for a session that isn't in the store, returning
+// `ErrNoSuchSession` if nobody has it. It must be called without holding the
+// store's lock.
+func (st *MemoryStore) find(id string) (*Session, error) {
+	st.mu.RLock()
+	b := st.bus
+	st.mu.RUnlock()
+
+	if b == nil {
+		return nil, ErrNoSuchSession
+	}
+
+	return b.find(id)
+}
+
+// Create implements `SessionStore`.
+func (st *MemoryStore) Create(id string, media Media, ts int, so socketio.Socket, nick string, opts SessionOptions) (*Session, error) {
+	// The session is set up before it goes into the store, so that nobody
+	// ever sees it without its password.
+	salt, hash, err := newPassword(opts.Password)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSession(id, media, ts)
+	s.mu.Lock()
+	s.configure(opts, salt, hash)
+	s.mu.Unlock()
+	st.attach(s)
+
+	st.mu.Lock()
+	if _, ok := st.sessions[id]; ok {
+		st.mu.Unlock()
+		s.detach()
+		return nil, ErrSessionExists
+	}
+
+	// The socket can't be in the session being created, so leaving its
+	// old one can't delete the new one from under it.
+	d, left := st.leave(so.Id(), LeaveLeft)
+
+	m := s.addMember(so, nick)
+	st.members[so.Id()] = m
+	st.add(s)
+	st.mu.Unlock()
+
+	if left {
+		st.departed(d)
+	}
+	st.changed()
+	m.welcome()
+
+	return s, nil
+}
+
+// Get implements `SessionStore`.
+func (st *MemoryStore) Get(id string) (*Session, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	s, ok := st.sessions[id]
+	return s, ok
+}
+
+// Member implements `SessionStore`.
+func (st *MemoryStore) Member(sockid string) (*Member, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	m, ok := st.members[sockid]
+	return m, ok
+}
+
+// Join implements `SessionStore`.
+func (st *MemoryStore) Join(id string, so socketio.Socket, nick string, c Credentials) (*Member, error) {
+	// Passwords are slow to hash, so that happens before the store is
+	// locked.
+	mid := so.Id()
+	if m, ok := st.Member(so.Id()); ok {
+		mid = m.ID
+	}
+	if s, ok := st.Get(id); ok {
+		if err := s.hash(&c, mid); err != nil {
+			return nil, err
+		}
+	}
+
+	st.mu.Lock()
+	s, ok := st.sessions[id]
+	var replica *Session
+	if !ok {
+		st.mu.Unlock()
+
+		var err error
+		replica, err = st.find(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := replica.hash(&c, mid); err != nil {
+			replica.detach()
+			return nil, err
+		}
+
+		st.mu.Lock()
+		// Somebody else may have brought the session in while we
+		// were looking for it.
+		if s, ok = st.sessions[id]; ok {
+			defer replica.detach()
+			replica = nil
+		} else {
+			s = replica
+		}
+	}
+
+	// Leaving the session only to join it again would delete it if the
+	// socket were its last member, so joining the session the socket is
+	// already in just syncs it again.
+	if m, ok := st.members[so.Id()]; ok && m.Session == s {
+		st.mu.Unlock()
+		if replica != nil {
+			replica.detach()
+		}
+		m.welcome()
+		return m, nil
+	}
+
+	used, err := s.admit(c)
+	if err != nil {
+		st.mu.Unlock()
+		if replica != nil {
+			replica.detach()
+		}
+		return nil, err
+	}
+	if replica != nil {
+		st.add(replica)
+	}
+
+	d, left := st.leave(so.Id(), LeaveLeft)
+
+	m := s.addMember(so, nick)
+	st.members[so.Id()] = m
+	st.mu.Unlock()
+
+	if left {
+		st.departed(d)
+	}
+	if used {
+		// This lets the store know too.
+		s.changed()
+	} else {
+		st.changed()
+	}
+	m.welcome()
+	s.memberJoined(m)
+
+	return m, nil
+}
+
+// Leave implements `SessionStore`.
+func (st *MemoryStore) Leave(sockid string) (*Member, bool) {
+	return st.depart(sockid, LeaveLeft)
+}
+
+// depart is `Leave`, telling everyone left in the session the member was in
+// that they are no longer in it for the given reason.
+func (st *MemoryStore) depart(sockid string, reason LeaveReason) (*Member, bool) {
+	st.mu.Lock()
+	d, ok := st.leave(sockid, reason)
+	st.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	st.departed(d)
+	st.changed()
+
+	return d.m, true
+}
+
+// departure is a member leaving a session, as recorded by `leave` for
+// `departed` to announce once the store's lock has been released.
+type departure struct {
+	m      *Member
+	reason LeaveReason
+
+	// changed is whether the state of the session changed because the
+	// member left, e.g. somebody else had to take over as host.
+	changed bool
+}
+
+// leave is `Leave` for callers already holding the store's lock. Because the
+// lock is held from removing the member until deleting the session, nobody
+// can join a session in between it becoming empty and being deleted, should
+// it be deleted straight away.
+//
+// The caller must call `departed` with the departure once it has released
+// the lock.
+func (st *MemoryStore) leave(sockid string, reason LeaveReason) (departure, bool) {
+	m, ok := st.members[sockid]
+	if !ok {
+		return departure{}, false
+	}
+
+	delete(st.members, sockid)
+	return st.remove(m, reason), true
+}
+
+// remove removes the given member from their session for the given reason,
+// deleting the session if it is now empty. The caller must hold the store's
+// lock, and call `departed` with the departure once it has released it.
+func (st *MemoryStore) remove(m *Member, reason LeaveReason) departure {
+	s := m.Session
+	n, changed := s.removeMember(m.ID)
+	if n == 0 && EmptyTTL <= 0 {
+		delete(st.sessions, s.SessionID)
+	}
+
+	return departure{m, reason, changed}
+}
+
+// Disconnect implements `SessionStore`.
+func (st *MemoryStore) Disconnect(sockid string) (*Member, bool) {
+	if ResumeGrace <= 0 {
+		return st.depart(sockid, LeaveDisconnected)
+	}
+
+	st.mu.Lock()
+	m, ok := st.members[sockid]
+	if !ok {
+		st.mu.Unlock()
+		return nil, false
+	}
+
+	delete(st.members, sockid)
+	s := m.Session
+	gen, changed := s.goAway(m)
+	st.mu.Unlock()
+
+	time.AfterFunc(ResumeGrace, func() { st.expire(m, gen) })
+
+	wm := s.wireMember(m)
+	s.publish(busMessage{Kind: "member", MemberID: m.ID, Member: &wm})
+	if changed {
+		s.changed()
+	}
+	s.Sync()
+
+	return m, true
+}
+
+// expire removes the given member from their session once they have been
+// away for `ResumeGrace`, unless they have resumed since their absence of the
+// given generation began.
+func (st *MemoryStore) expire(m *Member, gen int) {
+	st.mu.Lock()
+	s := m.Session
+	if st.sessions[s.SessionID] != s || !s.stillAway(m, gen) {
+		st.mu.Unlock()
+		return
+	}
+	d := st.remove(m, LeaveTimedOut)
+	st.mu.Unlock()
+
+	st.departed(d)
+	st.changed()
+}
+
+// Resume implements `SessionStore`.
+func (st *MemoryStore) Resume(sid string, id string, token string, so socketio.Socket) (*Member, error) {
+	st.mu.Lock()
+	s, ok := st.sessions[sid]
+	if !ok {
+		st.mu.Unlock()
+		return nil, ErrNoSuchSession
+	}
+
+	m, old, changed, err := s.resume(id, token, so)
+	if err != nil {
+		st.mu.Unlock()
+		return nil, err
+	}
+	if cur, ok := st.members[old]; ok && cur == m {
+		delete(st.members, old)
+	}
+
+	var d departure
+	var left bool
+	if cur, ok := st.members[so.Id()]; ok && cur != m {
+		d, left = st.leave(so.Id(), LeaveLeft)
+	}
+	st.members[so.Id()] = m
+	st.mu.Unlock()
+
+	if left {
+		st.departed(d)
+	}
+	wm := s.wireMember(m)
+	s.publish(busMessage{Kind: "member", MemberID: m.ID, Member: &wm})
+	if changed {
+		s.changed()
+	}
+	s.Sync()
+	m.welcome()
+
+	return m, nil
+}
+
+// departed tells everyone left in its session, on this server and others,
+// that a member has left it, and everyone the new state of the session if it
+// changed, stopping the session's timers and detaching it from the bus if it
+// was deleted as a result. It must be called without holding the store's
+// lock.
+func (st *MemoryStore) departed(d departure) {
+	s := d.m.Session
+	s.memberLeft(d.m, d.reason)
+
+	// The new host may well be on another server, even if there is
+	// nobody left on this one, so this has to happen before detaching.
+	if d.changed {
+		s.changed()
+		s.Sync()
+	}
+
+	if cur, ok := st.Get(s.SessionID); !ok || cur != s {
+		s.stop()
+	}
+}
+
+// Delete implements `SessionStore`.
+func (st *MemoryStore) Delete(id string) {
+	st.mu.Lock()
+	s, ok := st.sessions[id]
+	if !ok {
+		st.mu.Unlock()
+		return
+	}
+
+	st.drop(s)
+	st.mu.Unlock()
+
+	s.stop()
+	st.changed()
+}
+
+// drop removes the given session from the store, along with all of its
+// members, returning the sockets of those who aren't away so that they can be
+// told. The caller must hold the store's lock, and stop the session once it
+// has released it.
+func (st *MemoryStore) drop(s *Session) []socketio.Socket {
+	s.mu.Lock()
+	for _, m := range s.Members {
+		if st.members[m.Socket.Id()] == m {
+			delete(st.members, m.Socket.Id())
+		}
+	}
+	socks := s.sockets()
+	s.mu.Unlock()
+
+	delete(st.sessions, s.SessionID)
+	return socks
+}
+
+// WireSessions implements `SessionStore`.
+func (st *MemoryStore) WireSessions() map[string]WireSession {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	wms := make(map[string]WireSession, len(st.sessions))
+	for k, v := range st.sessions {
+		wms[k] = v.GetWireSession()
+	}
+	return wms
+}
@@ -0,0 +1,275 @@
+package models
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSocket is a `socketio.Socket` which remembers what it was sent.
+type fakeSocket struct {
+	id  string
+	req *http.Request
+
+	mu     sync.Mutex
+	events []string
+	args   []interface{}
+}
+
+func newFakeSocket(id string) *fakeSocket {
+	return &fakeSocket{
+		id:  id,
+		req: &http.Request{RemoteAddr: "192.0.2.1:1234", Header: http.Header{}},
+	}
+}
+
+func (so *fakeSocket) Id() string                   { return so.id }
+func (so *fakeSocket) Rooms() []string              { return nil }
+func (so *fakeSocket) Request() *http.Request       { return so.req }
+func (so *fakeSocket) On(string, interface{}) error { return nil }
+func (so *fakeSocket) Join(string) error            { return nil }
+func (so *fakeSocket) Leave(string) error           { return nil }
+
+func (so *fakeSocket) BroadcastTo(string, string, ...interface{}) error {
+	return nil
+}
+
+func (so *fakeSocket) Emit(event string, args ...interface{}) error {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	so.events = append(so.events, event)
+	var arg interface{}
+	if len(args) > 0 {
+		arg = args[0]
+	}
+	so.args = append(so.args, arg)
+	return nil
+}
+
+// sent returns how many times the socket was sent the given event.
+func (so *fakeSocket) sent(event string) int {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	n := 0
+	for _, e := range so.events {
+		if e == event {
+			n++
+		}
+	}
+	return n
+}
+
+// payloads returns what the socket was sent with each of the given event.
+func (so *fakeSocket) payloads(event string) []interface{} {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	var args []interface{}
+	for i, e := range so.events {
+		if e == event {
+			args = append(args, so.args[i])
+		}
+	}
+	return args
+}
+
+// testSettings makes stores created by the test delete sessions as soon as
+// they are empty, and not run a reaper or heartbeats unless the test starts
+// them, until the test is over. Nobody has tried any passwords yet.
+func testSettings(t *testing.T) {
+	reap, interval, ttl, idle, tries := ReapInterval, SyncInterval, EmptyTTL, IdleTimeout, passwordTries
+	ReapInterval, SyncInterval, EmptyTTL = 0, 0, 0
+	passwordTries = &triesLimiter{limiters: make(map[string]*chatLimiter)}
+	t.Cleanup(func() {
+		ReapInterval, SyncInterval, EmptyTTL, IdleTimeout, passwordTries = reap, interval, ttl, idle, tries
+	})
+}
+
+// newTestStore returns a `MemoryStore` created with `testSettings`.
+func newTestStore(t *testing.T) *MemoryStore {
+	testSettings(t)
+	return NewMemoryStore()
+}
+
+func TestJoinOwnSession(t *testing.T) {
+	st := newTestStore(t)
+	so := newFakeSocket("a")
+
+	s, err := st.Create("1", NetflixMedia(80018499), 0, so, "alice", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := st.Join("1", so, "alice", Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cur, ok := st.Get("1"); !ok || cur != s {
+		t.Fatal("joining the session the socket was alone in deleted it")
+	}
+	if m.Session != s {
+		t.Error("member was attached to a session which isn't in the store")
+	}
+	if n := s.Len(); n != 1 {
+		t.Errorf("session has %d members, want 1", n)
+	}
+}
+
+func TestCreateWhileAloneInSession(t *testing.T) {
+	st := newTestStore(t)
+	so := newFakeSocket("a")
+
+	if _, err := st.Create("1", NetflixMedia(80018499), 0, so, "alice", SessionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := st.Create("2", NetflixMedia(80018499), 0, so, "alice", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := st.Get("1"); ok {
+		t.Error("session left empty was not deleted")
+	}
+	if cur, ok := st.Get("2"); !ok || cur != s {
+		t.Fatal("created session is not in the store")
+	}
+	if m, ok := st.Member("a"); !ok || m.Session != s {
+		t.Error("socket is not a member of the created session")
+	}
+}
+
+func TestCreateWithPassword(t *testing.T) {
+	st := newTestStore(t)
+
+	if _, err := st.Create("1", NetflixMedia(80018499), 0, newFakeSocket("a"), "alice", SessionOptions{Password: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Join("1", newFakeSocket("b"), "bob", Credentials{}); err != ErrPasswordRequired {
+		t.Errorf("got error %v joining without the password, want %v", err, ErrPasswordRequired)
+	}
+	if _, err := st.Join("1", newFakeSocket("b"), "bob", Credentials{Password: "hunter3"}); err != ErrWrongPassword {
+		t.Errorf("got error %v joining with the wrong password, want %v", err, ErrWrongPassword)
+	}
+	if _, err := st.Join("1", newFakeSocket("c"), "carol", Credentials{Password: "hunter2"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPasswordTriesLimited(t *testing.T) {
+	st := newTestStore(t)
+	burst := PasswordBurst
+	PasswordBurst = 2
+	defer func() { PasswordBurst = burst }()
+
+	s, err := st.Create("1", NetflixMedia(80018499), 0, newFakeSocket("a"), "alice", SessionOptions{Password: "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Members have shown their password already, so theirs isn't tried.
+	for i := 0; i < 3; i++ {
+		if err := s.Authorize("a", Credentials{Password: "wrong", IP: "192.0.2.1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := st.Join("1", newFakeSocket("b"), "bob", Credentials{Password: "wrong", IP: "192.0.2.2"}); err != ErrWrongPassword {
+			t.Fatalf("got error %v, want %v", err, ErrWrongPassword)
+		}
+	}
+	if _, err := st.Join("1", newFakeSocket("b"), "bob", Credentials{Password: "hunter2", IP: "192.0.2.2"}); err != ErrRateLimited {
+		t.Errorf("got error %v, want %v", err, ErrRateLimited)
+	}
+	if err := s.Authorize("c", Credentials{Password: "hunter2", IP: "192.0.2.2:4321"}); err != ErrRateLimited {
+		t.Errorf("got error %v authorizing, want %v", err, ErrRateLimited)
+	}
+	if _, err := st.Join("1", newFakeSocket("c"), "carol", Credentials{Password: "hunter2", IP: "192.0.2.3"}); err != nil {
+		t.Errorf("another IP address was rate limited: %v", err)
+	}
+}
+
+func TestKickIsAnnouncedOnce(t *testing.T) {
+	st := newTestStore(t)
+	host, bob, carol := newFakeSocket("a"), newFakeSocket("b"), newFakeSocket("c")
+
+	s, err := st.Create("1", NetflixMedia(80018499), 0, host, "alice", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Join("1", bob, "bob", Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Join("1", carol, "carol", Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Kick("a", "b", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := bob.sent("flixy kicked"); n != 1 {
+		t.Errorf("kicked member was sent %d flixy kicked, want 1", n)
+	}
+	if n := carol.sent("flixy member kicked"); n != 1 {
+		t.Errorf("other member was sent %d flixy member kicked, want 1", n)
+	}
+	if n := carol.sent("flixy member left"); n != 0 {
+		t.Errorf("other member was sent %d flixy member left, want 0", n)
+	}
+	if n := s.Len(); n != 2 {
+		t.Errorf("session has %d members, want 2", n)
+	}
+}
+
+// TestStoreConcurrency joins, seeks, disconnects and resumes from many
+// goroutines at once while the session's heartbeat runs. It is meant to be run
+// with -race.
+func TestStoreConcurrency(t *testing.T) {
+	st := newTestStore(t)
+	SyncInterval = time.Millisecond
+
+	host := newFakeSocket("host")
+	s, err := st.Create("1", NetflixMedia(80018499), 0, host, "host", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			so := newFakeSocket("s" + strconv.Itoa(i))
+			m, err := st.Join("1", so, "member", Credentials{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			token := m.token
+			for j := 0; j < 10; j++ {
+				if err := s.SetTime(m.ID, i*1000+j, nil); err != nil {
+					t.Error(err)
+				}
+			}
+
+			st.Disconnect(so.Id())
+			again := newFakeSocket(so.Id() + "'")
+			if _, err := st.Resume("1", m.ID, token, again); err != nil {
+				t.Error(err)
+			}
+			s.SetTime(m.ID, i, nil)
+			st.WireSessions()
+		}(i)
+	}
+	wg.Wait()
+
+	if n := s.Len(); n != 17 {
+		t.Errorf("session has %d members, want 17", n)
+	}
+	st.Delete("1")
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// TokenSecret is the key invite and session tokens are signed with. It is
+// random unless set otherwise, in which case tokens only work on this server
+// until it exits; servers sharing sessions must all be given the same one.
+var TokenSecret []byte
+
+func init() {
+	TokenSecret = make([]byte, 32)
+	if _, err := rand.Read(TokenSecret); err != nil {
+		panic("could not generate a token secret: " + err.Error())
+	}
+}
+
+// sign returns the signature of the given message with `TokenSecret`.
+func sign(msg string) string {
+	mac := hmac.New(sha256.New, TokenSecret)
+	mac.Write([]byte(msg))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signed returns whether sig is the signature of the given message.
+func signed(msg, sig string) bool {
+	return hmac.Equal([]byte(sign(msg)), []byte(sig))
+}
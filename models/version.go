@@ -0,0 +1,48 @@
+package models
+
+import (
+	"errors"
+
+	"github.com/flixy/flixy/Godeps/_workspace/src/github.com/googollee/go-socket.io"
+)
+
+// ErrConflict is returned when a member tries to change a session based on a
+// version of its state that somebody else has since changed.
+var ErrConflict = errors.New("session has changed since that version")
+
+// Version returns the version of the session's state, which goes up by one
+// whenever its video, clock, queue, host, control policy, grants or
+// auto-pausing change.
+func (s *Session) Version() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.version
+}
+
+// checkVersion returns `ErrConflict` if a version is given and the session's
+// state is no longer at it. The caller must hold the session's lock, and
+// call `resync` for whoever gave the version once it has released it if so.
+func (s *Session) checkVersion(v *int64) error {
+	if v != nil && *v != s.version {
+		return ErrConflict
+	}
+	return nil
+}
+
+// resync sends the member with the given ID the session's current state, once
+// a change they made to an out-of-date version of it has been refused, so
+// that they can reconcile with it. It must be called without holding the
+// session's lock.
+func (s *Session) resync(by string) {
+	s.mu.Lock()
+	var so socketio.Socket
+	if m, ok := s.Members[by]; ok && !m.away {
+		so = m.Socket
+	}
+	s.mu.Unlock()
+
+	if so != nil {
+		so.Emit("flixy sync", s.GetWireSession())
+	}
+}
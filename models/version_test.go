@@ -0,0 +1,75 @@
+package models
+
+import "testing"
+
+func TestStaleVersionConflicts(t *testing.T) {
+	st := newTestStore(t)
+	so := newFakeSocket("a")
+
+	s, err := st.Create("1", NetflixMedia(80018499), 0, so, "alice", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := s.Version()
+	if err := s.Play("a", &stale); err != nil {
+		t.Fatal(err)
+	}
+
+	syncs := so.sent("flixy sync")
+	if err := s.Pause("a", &stale); err != ErrConflict {
+		t.Fatalf("got error %v, want %v", err, ErrConflict)
+	}
+	if s.Paused() {
+		t.Error("session was paused by a stale version")
+	}
+	if n := so.sent("flixy sync") - syncs; n != 1 {
+		t.Errorf("refused member was sent %d flixy sync, want 1", n)
+	}
+}
+
+func TestMissingVersionAccepted(t *testing.T) {
+	st := newTestStore(t)
+
+	s, err := st.Create("1", NetflixMedia(80018499), 0, newFakeSocket("a"), "alice", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTime("a", 1000, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Play("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.Paused() {
+		t.Error("session wasn't played")
+	}
+}
+
+func TestVersionGoesUp(t *testing.T) {
+	st := newTestStore(t)
+
+	s, err := st.Create("1", NetflixMedia(80018499), 0, newFakeSocket("a"), "alice", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		f    func(v *int64) error
+	}{
+		{"play", func(v *int64) error { return s.Play("a", v) }},
+		{"pause", func(v *int64) error { return s.Pause("a", v) }},
+		{"seek", func(v *int64) error { return s.SetTime("a", 5000, v) }},
+		{"video change", func(v *int64) error {
+			return s.ChangeVideo("a", NetflixMedia(70143836), 0, 0, v)
+		}},
+	} {
+		v := s.Version()
+		if err := c.f(&v); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := s.Version(); got != v+1 {
+			t.Errorf("%s: version went from %d to %d, want %d", c.name, v, got, v+1)
+		}
+	}
+}